@@ -0,0 +1,54 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/acouvreur/traefik-modsecurity-plugin/wafauth"
+)
+
+const (
+	authModeBearer = "bearer"
+	authModeHMAC   = "hmac"
+)
+
+// loadAuthSecret reads the secret used to sign the requests to the WAF from
+// a file or an environment variable.
+func loadAuthSecret(config *Config) ([]byte, error) {
+	if config.AuthMode == "" {
+		return nil, nil
+	}
+	if config.AuthMode != authModeBearer && config.AuthMode != authModeHMAC {
+		return nil, fmt.Errorf("unsupported authMode %q", config.AuthMode)
+	}
+
+	var secret []byte
+	switch {
+	case config.AuthSecretFile != "":
+		data, err := os.ReadFile(config.AuthSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read authSecretFile: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	case config.AuthSecretEnv != "":
+		secret = []byte(os.Getenv(config.AuthSecretEnv))
+	}
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("authMode %s requires a non empty authSecretFile or authSecretEnv", config.AuthMode)
+	}
+	return secret, nil
+}
+
+// signRequest adds the credentials expected by the WAF side verifier.
+func (a *Modsecurity) signRequest(proxyReq *http.Request, body []byte) {
+	switch a.authMode {
+	case authModeBearer:
+		wafauth.SignBearer(proxyReq, a.authSecret)
+	case authModeHMAC:
+		wafauth.SignHMAC(proxyReq, a.authSecret, body, time.Now())
+	}
+}
@@ -0,0 +1,92 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/acouvreur/traefik-modsecurity-plugin/wafauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_SignsWafRequests(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MODSECURITY_TEST_SECRET", "env-secret")
+
+	tests := []struct {
+		name     string
+		config   Config
+		verifier *wafauth.Verifier
+	}{
+		{
+			name:     "Bearer token from environment",
+			config:   Config{AuthMode: "bearer", AuthSecretEnv: "MODSECURITY_TEST_SECRET"},
+			verifier: wafauth.NewBearerVerifier([]byte("env-secret")),
+		},
+		{
+			name:     "HMAC signature from file",
+			config:   Config{AuthMode: "hmac", AuthSecretFile: secretFile},
+			verifier: wafauth.NewHMACVerifier([]byte("file-secret"), time.Minute),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(tt.verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			defer modsecurityMockServer.Close()
+
+			config := CreateConfig()
+			config.ModSecurityUrl = modsecurityMockServer.URL
+			config.AuthMode = tt.config.AuthMode
+			config.AuthSecretFile = tt.config.AuthSecretFile
+			config.AuthSecretEnv = tt.config.AuthSecretEnv
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			handler, err := New(context.Background(), next, config, "modsecurity-middleware")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// identical requests in the same second are not replays
+			for i := 0; i < 2; i++ {
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/website?test=1", bytes.NewBufferString("Request")))
+
+				assert.Equal(t, http.StatusOK, rw.Code)
+			}
+		})
+	}
+}
+
+func TestLoadAuthSecret_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{
+			name:   "Unknown mode",
+			config: Config{AuthMode: "basic", AuthSecretEnv: "HOME"},
+		},
+		{
+			name:   "Missing secret",
+			config: Config{AuthMode: "hmac"},
+		},
+		{
+			name:   "Empty environment variable",
+			config: Config{AuthMode: "bearer", AuthSecretEnv: "MODSECURITY_TEST_UNSET"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadAuthSecret(&tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
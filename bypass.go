@@ -0,0 +1,129 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	bypassModeSkip   = "skip"
+	bypassModeDetect = "detect"
+
+	defaultBypassHeader = "X-Waf-Bypass"
+)
+
+var (
+	errBypassMalformed = errors.New("malformed bypass token")
+	errBypassExpired   = errors.New("expired bypass token")
+	errBypassForged    = errors.New("invalid bypass token signature")
+)
+
+// bypassVerifier checks the tokens allowing trusted clients to skip the WAF.
+// A token is "<identity>:<expiry>:<signature>" where expiry is a unix
+// timestamp and signature the hex HMAC-SHA256 of "<identity>:<expiry>".
+type bypassVerifier struct {
+	header  string
+	mode    string
+	secrets [][]byte
+	now     func() time.Time
+}
+
+// newBypassVerifier returns nil when no bypass secret is configured.
+func newBypassVerifier(config *Config) (*bypassVerifier, error) {
+	if len(config.BypassSecrets) == 0 {
+		return nil, nil
+	}
+
+	mode := config.BypassMode
+	if mode == "" {
+		mode = bypassModeSkip
+	}
+	if mode != bypassModeSkip && mode != bypassModeDetect {
+		return nil, fmt.Errorf("unsupported bypassMode %q", config.BypassMode)
+	}
+
+	header := config.BypassHeader
+	if header == "" {
+		header = defaultBypassHeader
+	}
+
+	v := &bypassVerifier{header: header, mode: mode, now: time.Now}
+	for _, secret := range config.BypassSecrets {
+		if secret == "" {
+			return nil, fmt.Errorf("bypassSecrets cannot contain empty secrets")
+		}
+		v.secrets = append(v.secrets, []byte(secret))
+	}
+	return v, nil
+}
+
+func bypassSignature(secret []byte, identity string, expiry string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(identity + ":" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the identity of a valid token.
+func (v *bypassVerifier) verify(token string) (string, error) {
+	sigIdx := strings.LastIndex(token, ":")
+	if sigIdx < 0 {
+		return "", errBypassMalformed
+	}
+	expIdx := strings.LastIndex(token[:sigIdx], ":")
+	if expIdx <= 0 {
+		return "", errBypassMalformed
+	}
+	identity, expiry, signature := token[:expIdx], token[expIdx+1:sigIdx], token[sigIdx+1:]
+
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", errBypassMalformed
+	}
+
+	valid := false
+	for _, secret := range v.secrets {
+		if hmac.Equal([]byte(bypassSignature(secret, identity, expiry)), []byte(signature)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", errBypassForged
+	}
+	if !v.now().Before(time.Unix(unix, 0)) {
+		return "", errBypassExpired
+	}
+	return identity, nil
+}
+
+// checkBypass returns the bypass mode granted to req, or an empty string when
+// the request must be inspected as usual. The token is removed from the
+// request so that it never reaches the WAF or the service.
+func (a *Modsecurity) checkBypass(req *http.Request) string {
+	if a.bypass == nil {
+		return ""
+	}
+	token := req.Header.Get(a.bypass.header)
+	if token == "" {
+		return ""
+	}
+	req.Header.Del(a.bypass.header)
+
+	identity, err := a.bypass.verify(token)
+	if err != nil {
+		a.logger.Printf("bypass token rejected from %s for %s %s: %s", req.RemoteAddr, req.Method, req.URL.Path, err.Error())
+		a.metrics.inc("bypass_rejected")
+		return ""
+	}
+
+	a.logger.Printf("bypass token accepted for %q from %s, mode %s, for %s %s", identity, req.RemoteAddr, a.bypass.mode, req.Method, req.URL.Path)
+	a.metrics.inc("bypass_accepted")
+	return a.bypass.mode
+}
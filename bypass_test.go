@@ -0,0 +1,159 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signBypassToken(secret string, identity string, expiry time.Time) string {
+	exp := fmt.Sprint(expiry.Unix())
+	return identity + ":" + exp + ":" + bypassSignature([]byte(secret), identity, exp)
+}
+
+func TestBypassVerifier_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v, err := newBypassVerifier(&Config{BypassSecrets: []string{"current", "previous"}})
+	assert.NoError(t, err)
+	v.now = func() time.Time { return now }
+
+	tests := []struct {
+		name           string
+		token          string
+		expectIdentity string
+		expectErr      error
+	}{
+		{
+			name:           "Accepts valid token",
+			token:          signBypassToken("current", "pentest:alice", now.Add(time.Hour)),
+			expectIdentity: "pentest:alice",
+		},
+		{
+			name:           "Accepts token signed with a rotated secret",
+			token:          signBypassToken("previous", "synthetic", now.Add(time.Hour)),
+			expectIdentity: "synthetic",
+		},
+		{
+			name:      "Rejects expired token",
+			token:     signBypassToken("current", "pentest", now.Add(-time.Second)),
+			expectErr: errBypassExpired,
+		},
+		{
+			name:      "Rejects forged token",
+			token:     signBypassToken("guessed", "pentest", now.Add(time.Hour)),
+			expectErr: errBypassForged,
+		},
+		{
+			name:      "Rejects token with extended expiry",
+			token:     "pentest:1800000000:" + bypassSignature([]byte("current"), "pentest", "1700003600"),
+			expectErr: errBypassForged,
+		},
+		{
+			name:      "Rejects malformed token",
+			token:     "pentest",
+			expectErr: errBypassMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := v.verify(tt.token)
+
+			assert.Equal(t, tt.expectErr, err)
+			assert.Equal(t, tt.expectIdentity, identity)
+		})
+	}
+}
+
+func TestModsecurity_ServeHTTP_Bypass(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		token        string
+		expectStatus int
+		expectWaf    bool
+		expectMetric string
+	}{
+		{
+			name:         "Skips WAF with a valid token",
+			mode:         bypassModeSkip,
+			token:        signBypassToken("secret", "pentest", time.Now().Add(time.Hour)),
+			expectStatus: http.StatusOK,
+			expectWaf:    false,
+			expectMetric: "bypass_accepted",
+		},
+		{
+			name:         "Inspects without blocking in detect mode",
+			mode:         bypassModeDetect,
+			token:        signBypassToken("secret", "pentest", time.Now().Add(time.Hour)),
+			expectStatus: http.StatusOK,
+			expectWaf:    true,
+			expectMetric: "bypass_detected",
+		},
+		{
+			name:         "Blocks with a forged token",
+			mode:         bypassModeSkip,
+			token:        signBypassToken("forged", "pentest", time.Now().Add(time.Hour)),
+			expectStatus: http.StatusForbidden,
+			expectWaf:    true,
+			expectMetric: "bypass_rejected",
+		},
+		{
+			name:         "Blocks with an expired token",
+			mode:         bypassModeSkip,
+			token:        signBypassToken("secret", "pentest", time.Now().Add(-time.Hour)),
+			expectStatus: http.StatusForbidden,
+			expectWaf:    true,
+			expectMetric: "bypass_rejected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCalled := false
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafCalled = true
+				assert.Empty(t, r.Header.Get(defaultBypassHeader))
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer modsecurityMockServer.Close()
+
+			bypass, err := newBypassVerifier(&Config{BypassSecrets: []string{"secret"}, BypassMode: tt.mode})
+			assert.NoError(t, err)
+
+			middleware := &Modsecurity{
+				next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Empty(t, r.Header.Get(defaultBypassHeader))
+				}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				bypass:         bypass,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.Header.Set(defaultBypassHeader, tt.token)
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectWaf, wafCalled)
+			assert.Equal(t, int64(1), middleware.metrics.get(tt.expectMetric))
+		})
+	}
+}
+
+func TestNewBypassVerifier_Errors(t *testing.T) {
+	_, err := newBypassVerifier(&Config{BypassSecrets: []string{"secret"}, BypassMode: "allow"})
+	assert.Error(t, err)
+
+	_, err = newBypassVerifier(&Config{BypassSecrets: []string{""}})
+	assert.Error(t, err)
+}
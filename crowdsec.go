@@ -0,0 +1,434 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	crowdsecScopeIP    = "ip"
+	crowdsecScopeRange = "range"
+	crowdsecTypeBan    = "ban"
+
+	// crowdsecScenario names the alerts pushed for the WAF blocks.
+	crowdsecScenario = "acouvreur/traefik-modsecurity-waf-block"
+)
+
+// crowdsecDecision is a decision of the LAPI stream, only ban decisions on
+// ip and range scopes are enforced.
+type crowdsecDecision struct {
+	ID       int64  `json:"id"`
+	Origin   string `json:"origin"`
+	Type     string `json:"type"`
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	Duration string `json:"duration"`
+	Scenario string `json:"scenario"`
+}
+
+type crowdsecStream struct {
+	New     []crowdsecDecision `json:"new"`
+	Deleted []crowdsecDecision `json:"deleted"`
+}
+
+type crowdsecBan struct {
+	network  *net.IPNet
+	until    time.Time
+	scenario string
+}
+
+// crowdsecBouncer enforces the decisions of a CrowdSec local API. The bans
+// are pulled from the decisions stream every interval and kept in memory, so
+// that a banned client is rejected without a call to the LAPI or the WAF.
+// With machine credentials, the WAF blocks are pushed back as alerts.
+type crowdsecBouncer struct {
+	url       string
+	apiKey    string
+	machineID string
+	password  string
+	status    int
+	interval  time.Duration
+	client    *http.Client
+	metrics   *metrics
+	logger    *log.Logger
+
+	mu      sync.RWMutex
+	ips     map[string]crowdsecBan
+	ranges  map[string]crowdsecBan
+	started bool
+
+	signals     chan event
+	token       string
+	tokenExpiry time.Time
+}
+
+func newCrowdsecBouncer(config *Config, m *metrics, logger *log.Logger) (*crowdsecBouncer, error) {
+	if config.CrowdsecLapiUrl == "" {
+		return nil, nil
+	}
+	if config.CrowdsecApiKey == "" {
+		return nil, fmt.Errorf("crowdsecApiKey cannot be empty")
+	}
+	if (config.CrowdsecMachineId == "") != (config.CrowdsecPassword == "") {
+		return nil, fmt.Errorf("crowdsecMachineId and crowdsecPassword must be set together")
+	}
+
+	b := &crowdsecBouncer{
+		url:       strings.TrimSuffix(config.CrowdsecLapiUrl, "/"),
+		apiKey:    config.CrowdsecApiKey,
+		machineID: config.CrowdsecMachineId,
+		password:  config.CrowdsecPassword,
+		status:    intOrDefault(config.CrowdsecBanStatus, http.StatusForbidden),
+		interval:  millisOrDefault(config.CrowdsecUpdateIntervalMillis, 10*time.Second),
+		client:    &http.Client{Timeout: millisOrDefault(config.CrowdsecTimeoutMillis, 5*time.Second)},
+		metrics:   m,
+		logger:    logger,
+		ips:       make(map[string]crowdsecBan),
+		ranges:    make(map[string]crowdsecBan),
+	}
+	if !isErrorStatus(b.status) {
+		return nil, fmt.Errorf("unsupported crowdsecBanStatus %d", config.CrowdsecBanStatus)
+	}
+	if b.machineID != "" {
+		b.signals = make(chan event, intOrDefault(config.CrowdsecSignalBufferSize, 1000))
+	}
+	return b, nil
+}
+
+// crowdsecBanned rejects the clients banned by CrowdSec.
+func (a *Modsecurity) crowdsecBanned(rw http.ResponseWriter, req *http.Request) bool {
+	if a.crowdsec == nil {
+		return false
+	}
+	scenario, banned := a.crowdsec.banned(clientIP(req), time.Now())
+	if !banned {
+		return false
+	}
+
+	a.metrics.inc("crowdsec_blocked")
+	a.logger.Printf("crowdsec banned %s (%s) for %s %s", clientIP(req), scenario, req.Method, req.URL.Path)
+	a.emit(a.newEvent(req, eventActionBlock, "crowdsec", a.crowdsec.status))
+	http.Error(rw, "", a.crowdsec.status)
+	return true
+}
+
+// banned returns the scenario of the decision banning ip.
+func (b *crowdsecBouncer) banned(ip string, now time.Time) (string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if ban, ok := b.ips[parsed.String()]; ok && now.Before(ban.until) {
+		return ban.scenario, true
+	}
+	for _, ban := range b.ranges {
+		if now.Before(ban.until) && ban.network.Contains(parsed) {
+			return ban.scenario, true
+		}
+	}
+	return "", false
+}
+
+// send queues the WAF blocks reported to CrowdSec as signals.
+func (b *crowdsecBouncer) send(ev event) {
+	if b.signals == nil || ev.Action != eventActionBlock || ev.Reason != "waf" {
+		return
+	}
+	select {
+	case b.signals <- ev:
+	default:
+		b.metrics.inc("crowdsec_signals_dropped")
+	}
+}
+
+// run pulls the decisions and pushes the signals every interval until ctx
+// is done.
+func (b *crowdsecBouncer) run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := b.pull(ctx); err != nil {
+			b.metrics.inc("crowdsec_pull_errors")
+			b.logger.Printf("crowdsec: fail to pull decisions: %s", err.Error())
+		}
+		b.pushSignals(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pull applies the decisions added and deleted since the last call. The
+// first call asks for all the active decisions.
+func (b *crowdsecBouncer) pull(ctx context.Context) error {
+	b.mu.RLock()
+	startup := !b.started
+	b.mu.RUnlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		b.url+"/v1/decisions/stream?startup="+strconv.FormatBool(startup), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", b.apiKey)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var stream crowdsecStream
+	if err := json.NewDecoder(resp.Body).Decode(&stream); err != nil {
+		return fmt.Errorf("invalid decisions stream: %w", err)
+	}
+	b.apply(stream, time.Now())
+	return nil
+}
+
+func (b *crowdsecBouncer) apply(stream crowdsecStream, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.started = true
+	for _, d := range stream.Deleted {
+		switch strings.ToLower(d.Scope) {
+		case crowdsecScopeIP:
+			if ip := net.ParseIP(d.Value); ip != nil {
+				delete(b.ips, ip.String())
+			}
+		case crowdsecScopeRange:
+			delete(b.ranges, d.Value)
+		}
+	}
+
+	for _, d := range stream.New {
+		if !strings.EqualFold(d.Type, crowdsecTypeBan) {
+			continue
+		}
+		duration, err := time.ParseDuration(d.Duration)
+		if err != nil {
+			b.logger.Printf("crowdsec: ignore decision %d with invalid duration %q", d.ID, d.Duration)
+			continue
+		}
+		ban := crowdsecBan{until: now.Add(duration), scenario: d.Scenario}
+
+		switch strings.ToLower(d.Scope) {
+		case crowdsecScopeIP:
+			ip := net.ParseIP(d.Value)
+			if ip == nil {
+				b.logger.Printf("crowdsec: ignore decision %d with invalid ip %q", d.ID, d.Value)
+				continue
+			}
+			b.ips[ip.String()] = ban
+		case crowdsecScopeRange:
+			_, network, err := net.ParseCIDR(d.Value)
+			if err != nil {
+				b.logger.Printf("crowdsec: ignore decision %d with invalid range %q", d.ID, d.Value)
+				continue
+			}
+			ban.network = network
+			b.ranges[d.Value] = ban
+		}
+	}
+
+	// expired decisions are also deleted by the stream, this only bounds the
+	// memory if a deletion is missed
+	for k, ban := range b.ips {
+		if !now.Before(ban.until) {
+			delete(b.ips, k)
+		}
+	}
+	for k, ban := range b.ranges {
+		if !now.Before(ban.until) {
+			delete(b.ranges, k)
+		}
+	}
+	b.metrics.set("crowdsec_decisions", int64(len(b.ips)+len(b.ranges)))
+}
+
+type crowdsecMeta struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type crowdsecAlertEvent struct {
+	Timestamp string         `json:"timestamp"`
+	Meta      []crowdsecMeta `json:"meta"`
+}
+
+type crowdsecSource struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	IP    string `json:"ip"`
+}
+
+type crowdsecAlert struct {
+	Scenario        string               `json:"scenario"`
+	ScenarioHash    string               `json:"scenario_hash"`
+	ScenarioVersion string               `json:"scenario_version"`
+	Message         string               `json:"message"`
+	EventsCount     int                  `json:"events_count"`
+	StartAt         string               `json:"start_at"`
+	StopAt          string               `json:"stop_at"`
+	Capacity        int                  `json:"capacity"`
+	Leakspeed       string               `json:"leakspeed"`
+	Simulated       bool                 `json:"simulated"`
+	Events          []crowdsecAlertEvent `json:"events"`
+	Source          crowdsecSource       `json:"source"`
+}
+
+func newCrowdsecAlert(ev event) crowdsecAlert {
+	ts := ev.Time.UTC().Format(time.RFC3339)
+	return crowdsecAlert{
+		Scenario:        crowdsecScenario,
+		ScenarioVersion: "1.0",
+		Message:         fmt.Sprintf("%s blocked by %s: %s %s%s", ev.ClientIP, ev.Middleware, ev.Method, ev.Host, ev.URI),
+		EventsCount:     1,
+		StartAt:         ts,
+		StopAt:          ts,
+		Leakspeed:       "0",
+		Events: []crowdsecAlertEvent{{
+			Timestamp: ts,
+			Meta: []crowdsecMeta{
+				{Key: "source_ip", Value: ev.ClientIP},
+				{Key: "http_verb", Value: ev.Method},
+				{Key: "target_fqdn", Value: ev.Host},
+				{Key: "http_path", Value: ev.URI},
+				{Key: "http_status", Value: strconv.Itoa(ev.Status)},
+				{Key: "rule_ids", Value: strings.Join(ev.RuleIDs, ",")},
+			},
+		}},
+		Source: crowdsecSource{Scope: "Ip", Value: ev.ClientIP, IP: ev.ClientIP},
+	}
+}
+
+// pushSignals sends the queued WAF blocks as alerts. They are dropped when
+// the LAPI cannot be reached, CrowdSec does not need every single one.
+func (b *crowdsecBouncer) pushSignals(ctx context.Context) {
+	var alerts []crowdsecAlert
+drain:
+	for len(alerts) < cap(b.signals) {
+		select {
+		case ev := <-b.signals:
+			alerts = append(alerts, newCrowdsecAlert(ev))
+		default:
+			break drain
+		}
+	}
+	if len(alerts) == 0 {
+		return
+	}
+
+	if err := b.postAlerts(ctx, alerts); err != nil {
+		b.metrics.add("crowdsec_signals_dropped", int64(len(alerts)))
+		b.logger.Printf("crowdsec: fail to push %d signals: %s", len(alerts), err.Error())
+		return
+	}
+	b.metrics.add("crowdsec_signals_sent", int64(len(alerts)))
+}
+
+func (b *crowdsecBouncer) postAlerts(ctx context.Context, alerts []crowdsecAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := b.login(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url+"/v1/alerts", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		// the token may have been revoked before its expiry, log in again once
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			b.token = ""
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// login returns the machine token, logging in when it is missing or about
+// to expire. It is only called by run, so the token needs no lock.
+func (b *crowdsecBouncer) login(ctx context.Context) (string, error) {
+	if b.token != "" && time.Now().Add(time.Minute).Before(b.tokenExpiry) {
+		return b.token, nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"machine_id": b.machineID,
+		"password":   b.password,
+		"scenarios":  []string{crowdsecScenario},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url+"/v1/watchers/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Token  string `json:"token"`
+		Expire string `json:"expire"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid login response: %w", err)
+	}
+	expiry, err := time.Parse(time.RFC3339, result.Expire)
+	if err != nil {
+		// an unknown expiry is refreshed at the next push
+		expiry = time.Now()
+	}
+	b.token = result.Token
+	b.tokenExpiry = expiry
+	return b.token, nil
+}
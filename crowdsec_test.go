@@ -0,0 +1,226 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLAPI serves the decisions stream and records the pushed alerts.
+type fakeLAPI struct {
+	mu      sync.Mutex
+	streams []crowdsecStream
+	pulls   []string
+	logins  int
+	alerts  []crowdsecAlert
+}
+
+func (f *fakeLAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/v1/decisions/stream":
+		if r.Header.Get("X-Api-Key") != "bouncer-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.pulls = append(f.pulls, r.URL.Query().Get("startup"))
+		stream := crowdsecStream{}
+		if len(f.streams) > 0 {
+			stream, f.streams = f.streams[0], f.streams[1:]
+		}
+		json.NewEncoder(w).Encode(stream)
+	case "/v1/watchers/login":
+		var creds map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&creds)
+		if creds["machine_id"] != "waf" || creds["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.logins++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"code":   200,
+			"token":  "machine-token",
+			"expire": time.Now().Add(time.Hour).Format(time.RFC3339),
+		})
+	case "/v1/alerts":
+		if r.Header.Get("Authorization") != "Bearer machine-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var alerts []crowdsecAlert
+		json.NewDecoder(r.Body).Decode(&alerts)
+		f.alerts = append(f.alerts, alerts...)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestModsecurity_ServeHTTP_CrowdsecBan(t *testing.T) {
+	lapi := &fakeLAPI{streams: []crowdsecStream{{
+		New: []crowdsecDecision{
+			{ID: 1, Type: "ban", Scope: "Ip", Value: "10.0.0.1", Duration: "3h59m", Scenario: "crowdsecurity/http-probing"},
+			{ID: 2, Type: "ban", Scope: "Range", Value: "192.168.0.0/16", Duration: "1h", Scenario: "crowdsecurity/ssh-bf"},
+			{ID: 3, Type: "captcha", Scope: "Ip", Value: "10.0.0.3", Duration: "1h"},
+		},
+	}}}
+	lapiServer := httptest.NewServer(lapi)
+	defer lapiServer.Close()
+
+	var wafCalls int32
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&wafCalls, 1)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.CrowdsecLapiUrl = lapiServer.URL
+	config.CrowdsecApiKey = "bouncer-key"
+	config.CrowdsecUpdateIntervalMillis = 60000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := handler.(*Modsecurity)
+	middleware.logger = log.New(io.Discard, "", log.LstdFlags)
+	waitForMetric(t, middleware.metrics, "crowdsec_decisions", 2)
+
+	tests := []struct {
+		remoteAddr     string
+		expectedStatus int
+	}{
+		{remoteAddr: "10.0.0.1:1234", expectedStatus: http.StatusForbidden},
+		{remoteAddr: "192.168.4.2:1234", expectedStatus: http.StatusForbidden},
+		{remoteAddr: "10.0.0.2:1234", expectedStatus: http.StatusOK},
+		{remoteAddr: "10.0.0.3:1234", expectedStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+		})
+	}
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&wafCalls))
+	assert.Equal(t, int64(2), middleware.metrics.get("crowdsec_blocked"))
+}
+
+func TestCrowdsecBouncer_Pull(t *testing.T) {
+	lapi := &fakeLAPI{streams: []crowdsecStream{
+		{New: []crowdsecDecision{
+			{ID: 1, Type: "ban", Scope: "Ip", Value: "10.0.0.1", Duration: "1h"},
+			{ID: 2, Type: "ban", Scope: "Ip", Value: "2001:db8::1", Duration: "1h"},
+			{ID: 3, Type: "ban", Scope: "Range", Value: "172.16.0.0/12", Duration: "1h"},
+		}},
+		{Deleted: []crowdsecDecision{
+			{ID: 1, Type: "ban", Scope: "Ip", Value: "10.0.0.1", Duration: "-1s"},
+			{ID: 3, Type: "ban", Scope: "Range", Value: "172.16.0.0/12", Duration: "-1s"},
+		}},
+	}}
+	lapiServer := httptest.NewServer(lapi)
+	defer lapiServer.Close()
+
+	bouncer, err := newCrowdsecBouncer(&Config{CrowdsecLapiUrl: lapiServer.URL + "/", CrowdsecApiKey: "bouncer-key"},
+		newMetrics(), log.New(io.Discard, "", log.LstdFlags))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bouncer.pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, ip := range []string{"10.0.0.1", "2001:db8:0:0::1", "172.20.1.1"} {
+		_, banned := bouncer.banned(ip, now)
+		assert.True(t, banned, ip)
+	}
+	_, banned := bouncer.banned("10.0.0.1", now.Add(2*time.Hour))
+	assert.False(t, banned, "expired decision")
+
+	if err := bouncer.pull(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.1", "172.20.1.1"} {
+		_, banned := bouncer.banned(ip, now)
+		assert.False(t, banned, ip)
+	}
+	_, banned = bouncer.banned("2001:db8::1", now)
+	assert.True(t, banned)
+
+	assert.Equal(t, []string{"true", "false"}, lapi.pulls)
+	assert.Equal(t, int64(1), bouncer.metrics.get("crowdsec_decisions"))
+
+	bouncer.apiKey = "wrong"
+	assert.Error(t, bouncer.pull(context.Background()))
+}
+
+func TestCrowdsecBouncer_Signals(t *testing.T) {
+	lapi := &fakeLAPI{}
+	lapiServer := httptest.NewServer(lapi)
+	defer lapiServer.Close()
+
+	bouncer, err := newCrowdsecBouncer(&Config{
+		CrowdsecLapiUrl:   lapiServer.URL,
+		CrowdsecApiKey:    "bouncer-key",
+		CrowdsecMachineId: "waf",
+		CrowdsecPassword:  "secret",
+	}, newMetrics(), log.New(io.Discard, "", log.LstdFlags))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev := testEvent()
+	bouncer.send(ev)
+	ruleBlock := testEvent()
+	ruleBlock.Reason = "rule 1"
+	bouncer.send(ruleBlock)
+	wafError := testEvent()
+	wafError.Action = eventActionError
+	bouncer.send(wafError)
+
+	bouncer.pushSignals(context.Background())
+	bouncer.send(ev)
+	bouncer.pushSignals(context.Background())
+
+	assert.Equal(t, 1, lapi.logins)
+	assert.Len(t, lapi.alerts, 2)
+	assert.Equal(t, crowdsecScenario, lapi.alerts[0].Scenario)
+	assert.Equal(t, crowdsecSource{Scope: "Ip", Value: "172.18.0.1", IP: "172.18.0.1"}, lapi.alerts[0].Source)
+	assert.Contains(t, lapi.alerts[0].Events[0].Meta, crowdsecMeta{Key: "rule_ids", Value: "930100,949110"})
+	assert.Equal(t, int64(2), bouncer.metrics.get("crowdsec_signals_sent"))
+}
+
+func TestNewCrowdsecBouncer_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Missing API key", config: Config{CrowdsecLapiUrl: "http://crowdsec:8080"}},
+		{name: "Machine without password", config: Config{CrowdsecLapiUrl: "http://crowdsec:8080", CrowdsecApiKey: "key", CrowdsecMachineId: "waf"}},
+		{name: "Invalid ban status", config: Config{CrowdsecLapiUrl: "http://crowdsec:8080", CrowdsecApiKey: "key", CrowdsecBanStatus: 42}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCrowdsecBouncer(&tt.config, nil, nil)
+			assert.Error(t, err)
+		})
+	}
+}
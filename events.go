@@ -0,0 +1,61 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	eventActionBlock = "block"
+	eventActionError = "error"
+)
+
+// event describes a decision of the middleware sent to the event sinks.
+type event struct {
+	Time       time.Time `json:"time"`
+	Middleware string    `json:"middleware"`
+	Action     string    `json:"action"`
+	Reason     string    `json:"reason"`
+	ClientIP   string    `json:"clientIp"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	URI        string    `json:"uri"`
+	Status     int       `json:"status"`
+	RuleIDs    []string  `json:"ruleIds,omitempty"`
+	Score      int       `json:"score,omitempty"`
+}
+
+// eventSink receives the events of the middleware. send must never block.
+type eventSink interface {
+	send(ev event)
+}
+
+// clientIP returns the address of the peer, without its port.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (a *Modsecurity) newEvent(req *http.Request, action string, reason string, status int) event {
+	return event{
+		Time:       time.Now().UTC(),
+		Middleware: a.name,
+		Action:     action,
+		Reason:     reason,
+		ClientIP:   clientIP(req),
+		Method:     req.Method,
+		Host:       req.Host,
+		URI:        req.RequestURI,
+		Status:     status,
+	}
+}
+
+func (a *Modsecurity) emit(ev event) {
+	for _, sink := range a.sinks {
+		sink.send(ev)
+	}
+}
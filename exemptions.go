@@ -0,0 +1,74 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RuleExemption ignores WAF rules on the paths matching the regular
+// expression Path. A blocked request is let through when every rule it
+// matched is exempted.
+type RuleExemption struct {
+	Path    string   `json:"path,omitempty"`
+	RuleIDs []string `json:"ruleIds,omitempty"`
+}
+
+type ruleExemption struct {
+	path    *regexp.Regexp
+	ruleIDs map[string]bool
+}
+
+func compileExemptions(exemptions []RuleExemption) ([]*ruleExemption, error) {
+	compiled := make([]*ruleExemption, 0, len(exemptions))
+	for i, e := range exemptions {
+		if e.Path == "" {
+			return nil, fmt.Errorf("invalid rule exemption %d: path cannot be empty", i)
+		}
+		if len(e.RuleIDs) == 0 {
+			return nil, fmt.Errorf("invalid rule exemption %d (%s): ruleIds cannot be empty", i, e.Path)
+		}
+		path, err := regexp.Compile(e.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule exemption %d (%s): %w", i, e.Path, err)
+		}
+		c := &ruleExemption{path: path, ruleIDs: make(map[string]bool)}
+		for _, id := range e.RuleIDs {
+			c.ruleIDs[strings.TrimSpace(id)] = true
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// exempted returns true when every rule of a blocking verdict is exempted
+// on the path of req. The anomaly score evaluation rules only follow the
+// others and need no exemption. A verdict without rule IDs is never
+// exempted.
+func (a *Modsecurity) exempted(req *http.Request, verdict wafVerdict) bool {
+	if len(a.exemptions) == 0 || !verdict.blocked() {
+		return false
+	}
+
+	matched := 0
+	for _, id := range verdict.ruleIDs {
+		if isScoreEvaluationRule(id) {
+			continue
+		}
+		matched++
+		if !a.ruleExempted(req.URL.Path, id) {
+			return false
+		}
+	}
+	return matched > 0
+}
+
+func (a *Modsecurity) ruleExempted(path string, id string) bool {
+	for _, e := range a.exemptions {
+		if e.ruleIDs[id] && e.path.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ServeHTTP_RuleExemptions(t *testing.T) {
+	exemptions, err := compileExemptions([]RuleExemption{
+		{Path: "^/api/search$", RuleIDs: []string{"942100", "942190"}},
+		{Path: "^/api/", RuleIDs: []string{"920350"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		ruleIDs        string
+		expectedStatus int
+	}{
+		{name: "All rules exempted", path: "/api/search", ruleIDs: "942100,942190,949110", expectedStatus: http.StatusOK},
+		{name: "Rules exempted by two exemptions", path: "/api/search", ruleIDs: "942100 920350", expectedStatus: http.StatusOK},
+		{name: "One rule not exempted", path: "/api/search", ruleIDs: "942100,941100,949110", expectedStatus: http.StatusForbidden},
+		{name: "Rule exempted on another path", path: "/login", ruleIDs: "942100,949110", expectedStatus: http.StatusForbidden},
+		{name: "Only the score evaluation rule", path: "/api/search", ruleIDs: "949110", expectedStatus: http.StatusForbidden},
+		{name: "No rule IDs", path: "/api/search", expectedStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.ruleIDs != "" {
+					w.Header().Set("X-Waf-Rule-Ids", tt.ruleIDs)
+				}
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer modsecurityMockServer.Close()
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				ruleIDsHeader:  defaultRuleIDsHeader,
+				exemptions:     exemptions,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path+"?q=1", nil))
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			overridden := int64(0)
+			if tt.expectedStatus == http.StatusOK {
+				overridden = 1
+			}
+			assert.Equal(t, overridden, middleware.metrics.get("exemption_overridden"))
+		})
+	}
+}
+
+func TestCompileExemptions_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		exemption RuleExemption
+	}{
+		{name: "Missing path", exemption: RuleExemption{RuleIDs: []string{"942100"}}},
+		{name: "Missing rule IDs", exemption: RuleExemption{Path: "^/api/search$"}},
+		{name: "Invalid path", exemption: RuleExemption{Path: "^/api/(search$", RuleIDs: []string{"942100"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileExemptions([]RuleExemption{tt.exemption})
+			assert.Error(t, err)
+		})
+	}
+}
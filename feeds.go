@@ -0,0 +1,343 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	feedActionBlock  = "block"
+	feedActionTag    = "tag"
+	feedActionDetect = "detect"
+
+	feedFormatText = "text"
+	feedFormatCSV  = "csv"
+)
+
+// ThreatFeed is a local list of malicious IPs and CIDR ranges. Text feeds
+// hold one address per line, "#" and ";" starting comments. CSV feeds hold
+// the address in column (zero based); rows where it is not an address, such
+// as a header, are skipped.
+type ThreatFeed struct {
+	Name   string `json:"name,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Format string `json:"format,omitempty"`
+	Column int    `json:"column,omitempty"`
+	Action string `json:"action,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+type threatFeed struct {
+	name   string
+	format string
+	column int
+	action string
+	status int
+	source *fileSource
+
+	mu   sync.RWMutex
+	trie *cidrTrie
+}
+
+type threatFeeds struct {
+	feeds    []*threatFeed
+	interval time.Duration
+	metrics  *metrics
+	logger   *log.Logger
+}
+
+func newThreatFeeds(config *Config, m *metrics, logger *log.Logger) (*threatFeeds, error) {
+	if len(config.ThreatFeeds) == 0 {
+		return nil, nil
+	}
+
+	f := &threatFeeds{
+		interval: millisOrDefault(config.ThreatFeedsReloadMillis, 10*time.Second),
+		metrics:  m,
+		logger:   logger,
+	}
+	names := make(map[string]bool)
+	for i, c := range config.ThreatFeeds {
+		feed, err := newThreatFeed(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threat feed %d (%s): %w", i, c.Name, err)
+		}
+		if names[feed.name] {
+			return nil, fmt.Errorf("duplicate threat feed %q", feed.name)
+		}
+		names[feed.name] = true
+
+		if err := f.load(feed); err != nil {
+			return nil, fmt.Errorf("invalid threat feed %d (%s): %w", i, c.Name, err)
+		}
+		f.feeds = append(f.feeds, feed)
+	}
+	return f, nil
+}
+
+func newThreatFeed(c ThreatFeed) (*threatFeed, error) {
+	feed := &threatFeed{
+		name:   c.Name,
+		format: c.Format,
+		column: c.Column,
+		action: c.Action,
+		status: c.Status,
+		source: &fileSource{path: c.Path},
+	}
+	if feed.name == "" {
+		return nil, fmt.Errorf("name cannot be empty")
+	}
+	if c.Path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+
+	switch feed.format {
+	case "":
+		feed.format = feedFormatText
+	case feedFormatText, feedFormatCSV:
+	default:
+		return nil, fmt.Errorf("unsupported format %q", c.Format)
+	}
+
+	switch feed.action {
+	case "", feedActionBlock:
+		feed.action = feedActionBlock
+		if feed.status == 0 {
+			feed.status = http.StatusForbidden
+		}
+		if !isErrorStatus(feed.status) {
+			return nil, fmt.Errorf("unsupported status %d", c.Status)
+		}
+	case feedActionTag, feedActionDetect:
+	default:
+		return nil, fmt.Errorf("unsupported action %q", c.Action)
+	}
+	return feed, nil
+}
+
+// load parses the feed file again if it changed. On error, the previous
+// entries are kept.
+func (f *threatFeeds) load(feed *threatFeed) error {
+	data, changed, err := feed.source.load()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	trie, entries, invalid, err := parseThreatFeed(data, feed.format, feed.column)
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		f.logger.Printf("threat feed %s: skipped %d invalid entries", feed.name, invalid)
+	}
+
+	feed.mu.Lock()
+	feed.trie = trie
+	feed.mu.Unlock()
+
+	f.metrics.set("feed_entries_"+feed.name, int64(entries))
+	f.logger.Printf("threat feed %s: loaded %d entries", feed.name, entries)
+	return nil
+}
+
+// run checks the feed files every interval until ctx is done.
+func (f *threatFeeds) run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, feed := range f.feeds {
+				if err := f.load(feed); err != nil {
+					f.metrics.inc("feed_reload_errors")
+					f.logger.Printf("threat feed %s: fail to reload: %s", feed.name, err.Error())
+				}
+			}
+		}
+	}
+}
+
+func parseThreatFeed(data []byte, format string, column int) (*cidrTrie, int, int, error) {
+	trie := &cidrTrie{}
+	entries, invalid := 0, 0
+	add := func(value string) {
+		network, ok := parseNetwork(value)
+		if !ok {
+			invalid++
+			return
+		}
+		trie.insert(network)
+		entries++
+	}
+
+	if format == feedFormatCSV {
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comment = '#'
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		for row := 0; ; row++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			var value string
+			if column < len(record) {
+				value = strings.TrimSpace(record[column])
+			}
+			// a header row is expected and not worth a log line
+			if _, ok := parseNetwork(value); !ok && row == 0 {
+				continue
+			}
+			add(value)
+		}
+		return trie, entries, invalid, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		add(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+	return trie, entries, invalid, nil
+}
+
+// parseNetwork parses a CIDR range, or a single address as a /32 or /128.
+func parseNetwork(value string) (*net.IPNet, bool) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err == nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+}
+
+func (feed *threatFeed) contains(ip net.IP) bool {
+	feed.mu.RLock()
+	defer feed.mu.RUnlock()
+	return feed.trie.contains(ip)
+}
+
+// matchFeeds applies the feeds matching the client in order. Tag and
+// detect feeds are recorded and evaluation goes on, the first block feed
+// ends it. It returns true when the request has been answered.
+func (a *Modsecurity) matchFeeds(rw http.ResponseWriter, req *http.Request) bool {
+	if a.feeds == nil {
+		return false
+	}
+	ip := net.ParseIP(clientIP(req))
+	if ip == nil {
+		return false
+	}
+
+	for _, feed := range a.feeds.feeds {
+		if !feed.contains(ip) {
+			continue
+		}
+
+		a.metrics.inc("feed_hits_" + feed.action)
+		a.metrics.inc("feed_hits_name_" + feed.name)
+		a.logger.Printf("threat feed %s matched %s for %s %s, action %s", feed.name, ip, req.Method, req.URL.Path, feed.action)
+		switch feed.action {
+		case feedActionTag:
+			req.Header.Add(ruleTagHeader, "feed-"+feed.name)
+		case feedActionBlock:
+			a.emit(a.newEvent(req, eventActionBlock, "feed "+feed.name, feed.status))
+			http.Error(rw, "", feed.status)
+			return true
+		}
+	}
+	return false
+}
+
+// cidrTrie is a binary trie of the network prefixes, a lookup costs at most
+// one step per bit of the address.
+type cidrTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	leaf     bool
+}
+
+func (t *cidrTrie) insert(network *net.IPNet) {
+	ones, bits := network.Mask.Size()
+	ip, root := network.IP.To4(), &t.v4
+	if bits != 8*net.IPv4len || ip == nil {
+		ip, root = network.IP.To16(), &t.v6
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+
+	node := *root
+	for i := 0; i < ones; i++ {
+		if node.leaf {
+			// already covered by a wider range
+			return
+		}
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.leaf = true
+	node.children = [2]*trieNode{}
+}
+
+func (t *cidrTrie) contains(ip net.IP) bool {
+	if t == nil {
+		return false
+	}
+	node := t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node = ip4, t.v4
+	}
+
+	for i := 0; node != nil; i++ {
+		if node.leaf {
+			return true
+		}
+		if i == len(ip)*8 {
+			return false
+		}
+		node = node.children[ip[i/8]>>(7-uint(i%8))&1]
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCidrTrie(t *testing.T) {
+	trie := &cidrTrie{}
+	for _, value := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.7", "2001:db8::/32", "2001:db8:1::1"} {
+		network, ok := parseNetwork(value)
+		if !ok {
+			t.Fatal(value)
+		}
+		trie.insert(network)
+	}
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{ip: "10.200.3.4", expected: true},
+		{ip: "10.1.2.3", expected: true},
+		{ip: "11.0.0.1", expected: false},
+		{ip: "192.0.2.7", expected: true},
+		{ip: "192.0.2.8", expected: false},
+		{ip: "::ffff:10.0.0.1", expected: true},
+		{ip: "2001:db8:ffff::1", expected: true},
+		{ip: "2001:db9::1", expected: false},
+		{ip: "::1", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.expected, trie.contains(net.ParseIP(tt.ip)))
+		})
+	}
+
+	var empty *cidrTrie
+	assert.False(t, empty.contains(net.ParseIP("10.0.0.1")))
+}
+
+func TestParseThreatFeed(t *testing.T) {
+	text := "# tor exit nodes\n185.220.101.1\n185.220.102.0/24 ; range\n\nnot-an-ip\n2a0b:f4c2::1 extra fields\n"
+	trie, entries, invalid, err := parseThreatFeed([]byte(text), feedFormatText, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, entries)
+	assert.Equal(t, 1, invalid)
+	assert.True(t, trie.contains(net.ParseIP("185.220.102.44")))
+	assert.True(t, trie.contains(net.ParseIP("2a0b:f4c2::1")))
+
+	csv := "first_seen,ip_address,source\n2024-05-22,198.51.100.0/24,shodan\n2024-05-22,\"203.0.113.9\",censys\n2024-05-23,unknown,censys\n"
+	trie, entries, invalid, err = parseThreatFeed([]byte(csv), feedFormatCSV, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, entries)
+	assert.Equal(t, 1, invalid)
+	assert.True(t, trie.contains(net.ParseIP("198.51.100.200")))
+	assert.True(t, trie.contains(net.ParseIP("203.0.113.9")))
+}
+
+func TestModsecurity_ServeHTTP_ThreatFeeds(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "tor.txt"), []byte("185.220.101.0/24\n"), now)
+	writeFile(t, filepath.Join(dir, "scanners.csv"), []byte("ip,source\n198.51.100.7,shodan\n185.220.101.9,censys\n"), now)
+	writeFile(t, filepath.Join(dir, "watch.txt"), []byte("203.0.113.0/24\n"), now)
+
+	var wafTags []string
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafTags = r.Header.Values(ruleTagHeader)
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.ThreatFeeds = []ThreatFeed{
+		{Name: "scanners", Path: filepath.Join(dir, "scanners.csv"), Format: feedFormatCSV, Action: feedActionTag},
+		{Name: "tor", Path: filepath.Join(dir, "tor.txt"), Status: http.StatusUnavailableForLegalReasons},
+		{Name: "watch", Path: filepath.Join(dir, "watch.txt"), Action: feedActionDetect},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := handler.(*Modsecurity)
+	middleware.logger = log.New(io.Discard, "", log.LstdFlags)
+
+	tests := []struct {
+		remoteAddr     string
+		expectedStatus int
+		expectedTags   []string
+	}{
+		{remoteAddr: "185.220.101.9:1234", expectedStatus: http.StatusUnavailableForLegalReasons},
+		{remoteAddr: "198.51.100.7:1234", expectedStatus: http.StatusOK, expectedTags: []string{"feed-scanners"}},
+		{remoteAddr: "203.0.113.1:1234", expectedStatus: http.StatusOK},
+		{remoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			wafTags = nil
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(ruleTagHeader, "spoofed")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			assert.Equal(t, tt.expectedTags, wafTags)
+		})
+	}
+
+	assert.Equal(t, int64(1), middleware.metrics.get("feed_hits_name_tor"))
+	assert.Equal(t, int64(2), middleware.metrics.get("feed_hits_name_scanners"))
+	assert.Equal(t, int64(1), middleware.metrics.get("feed_hits_detect"))
+	assert.Equal(t, int64(2), middleware.metrics.get("feed_entries_scanners"))
+}
+
+func TestThreatFeeds_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tor.txt")
+	now := time.Now()
+	writeFile(t, path, []byte("185.220.101.1\n"), now)
+
+	feeds, err := newThreatFeeds(&Config{
+		ThreatFeeds:             []ThreatFeed{{Name: "tor", Path: path}},
+		ThreatFeedsReloadMillis: 10,
+	}, newMetrics(), log.New(io.Discard, "", log.LstdFlags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feeds.run(ctx)
+
+	feed := feeds.feeds[0]
+	assert.True(t, feed.contains(net.ParseIP("185.220.101.1")))
+
+	writeFile(t, path, []byte("185.220.101.2\n185.220.101.3\n"), now.Add(time.Minute))
+	waitForMetric(t, feeds.metrics, "feed_entries_tor", 2)
+	assert.False(t, feed.contains(net.ParseIP("185.220.101.1")))
+	assert.True(t, feed.contains(net.ParseIP("185.220.101.3")))
+}
+
+func TestNewThreatFeeds_Errors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.txt")
+	writeFile(t, path, []byte("10.0.0.1\n"), time.Now())
+
+	tests := []struct {
+		name  string
+		feeds []ThreatFeed
+	}{
+		{name: "Missing name", feeds: []ThreatFeed{{Path: path}}},
+		{name: "Missing file", feeds: []ThreatFeed{{Name: "tor", Path: path + ".missing"}}},
+		{name: "Unknown action", feeds: []ThreatFeed{{Name: "tor", Path: path, Action: "allow"}}},
+		{name: "Invalid status", feeds: []ThreatFeed{{Name: "tor", Path: path, Status: 200}}},
+		{name: "Unknown format", feeds: []ThreatFeed{{Name: "tor", Path: path, Format: "json"}}},
+		{name: "Duplicate name", feeds: []ThreatFeed{{Name: "tor", Path: path}, {Name: "tor", Path: path}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newThreatFeeds(&Config{ThreatFeeds: tt.feeds}, nil, log.New(io.Discard, "", log.LstdFlags))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	unhealthyReject = "reject"
+	unhealthyBypass = "bypass"
+)
+
+// healthChecker probes the WAF in the background and tracks its health.
+type healthChecker struct {
+	path           string
+	expectedStatus int
+	interval       time.Duration
+	timeout        time.Duration
+	threshold      int
+	policy         string
+
+	// healthy is 1 while the WAF is considered healthy
+	healthy  int32
+	failures int
+}
+
+func newHealthChecker(config *Config) *healthChecker {
+	if config.HealthCheckIntervalMillis <= 0 {
+		return nil
+	}
+	path := config.HealthCheckPath
+	if path == "" {
+		path = "/"
+	}
+	return &healthChecker{
+		path:           path,
+		expectedStatus: intOrDefault(config.HealthCheckExpectedStatus, http.StatusOK),
+		interval:       time.Duration(config.HealthCheckIntervalMillis) * time.Millisecond,
+		timeout:        millisOrDefault(config.HealthCheckTimeoutMillis, time.Second),
+		threshold:      intOrDefault(config.HealthCheckUnhealthyThreshold, 1),
+		policy:         config.UnhealthyPolicy,
+		healthy:        1,
+	}
+}
+
+func (h *healthChecker) isHealthy() bool {
+	return h == nil || atomic.LoadInt32(&h.healthy) == 1
+}
+
+// startHealthCheck probes the WAF right away and then every interval until
+// ctx is done.
+func (a *Modsecurity) startHealthCheck(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(a.health.interval)
+		defer ticker.Stop()
+		for {
+			a.checkHealth(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (a *Modsecurity) checkHealth(ctx context.Context) {
+	h := a.health
+	defer func() {
+		a.metrics.set("waf_healthy", int64(atomic.LoadInt32(&h.healthy)))
+	}()
+
+	err := a.probe(ctx)
+	if err == nil {
+		h.failures = 0
+		if atomic.SwapInt32(&h.healthy, 1) == 0 {
+			a.logger.Printf("modsec is healthy again")
+		}
+		return
+	}
+
+	h.failures++
+	a.metrics.inc("health_check_failures")
+	if h.failures >= h.threshold && atomic.SwapInt32(&h.healthy, 0) == 1 {
+		a.logger.Printf("modsec is unhealthy: %s", err.Error())
+	}
+}
+
+type unexpectedStatusError int
+
+func (e unexpectedStatusError) Error() string {
+	return "unexpected status " + strconv.Itoa(int(e))
+}
+
+func (a *Modsecurity) probe(ctx context.Context) error {
+	status, err := a.wafStatus(ctx, a.health.path, a.health.timeout)
+	if err != nil {
+		return err
+	}
+	if status != a.health.expectedStatus {
+		return unexpectedStatusError(status)
+	}
+	return nil
+}
+
+// wafStatus sends a GET request for path to the WAF and returns the status.
+func (a *Modsecurity) wafStatus(ctx context.Context, path string, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.modSecurityUrl+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	a.signRequest(req, nil)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// unhealthy applies the unhealthy policy while the WAF is down. It returns
+// true if the request was answered, false if it must go on, either to the
+// WAF or bypassing it as told by bypass.
+func (a *Modsecurity) unhealthy(rw http.ResponseWriter, req *http.Request) (answered bool, bypass bool) {
+	if a.health.isHealthy() || a.health.policy == "" {
+		return false, false
+	}
+	if a.health.policy == unhealthyBypass {
+		a.metrics.inc("requests_unhealthy_bypassed")
+		return false, true
+	}
+	a.metrics.inc("requests_unhealthy_rejected")
+	rw.Header().Set("Retry-After", strconv.Itoa(a.retryAfter))
+	http.Error(rw, "", http.StatusServiceUnavailable)
+	return true, false
+}
+
+// serveHealth answers with the health of the WAF, 200 when healthy and 503
+// otherwise.
+func (a *Modsecurity) serveHealth(rw http.ResponseWriter) {
+	status, code := "healthy", http.StatusOK
+	if !a.health.isHealthy() {
+		status, code = "unhealthy", http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]string{"status": status})
+}
@@ -0,0 +1,136 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_CheckHealth(t *testing.T) {
+	var status int32 = http.StatusOK
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer modsecurityMockServer.Close()
+
+	middleware := &Modsecurity{
+		modSecurityUrl: modsecurityMockServer.URL,
+		httpClient:     http.DefaultClient,
+		logger:         log.New(io.Discard, "", log.LstdFlags),
+		metrics:        newMetrics(),
+		health: newHealthChecker(&Config{
+			HealthCheckIntervalMillis:     1000,
+			HealthCheckPath:               "/healthz",
+			HealthCheckUnhealthyThreshold: 2,
+		}),
+	}
+
+	middleware.checkHealth(context.Background())
+	assert.True(t, middleware.health.isHealthy())
+	assert.Equal(t, int64(1), middleware.metrics.get("waf_healthy"))
+
+	atomic.StoreInt32(&status, http.StatusBadGateway)
+	middleware.checkHealth(context.Background())
+	assert.True(t, middleware.health.isHealthy(), "unhealthy before the threshold")
+	middleware.checkHealth(context.Background())
+	assert.False(t, middleware.health.isHealthy())
+	assert.Equal(t, int64(0), middleware.metrics.get("waf_healthy"))
+	assert.Equal(t, int64(2), middleware.metrics.get("health_check_failures"))
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	middleware.checkHealth(context.Background())
+	assert.True(t, middleware.health.isHealthy())
+}
+
+func TestModsecurity_ServeHTTP_Unhealthy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		expectStatus int
+		expectWaf    bool
+	}{
+		{
+			name:         "Fails fast while the WAF is unhealthy",
+			policy:       unhealthyReject,
+			expectStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "Bypasses the WAF while it is unhealthy",
+			policy:       unhealthyBypass,
+			expectStatus: http.StatusOK,
+		},
+		{
+			name:         "Keeps calling the WAF without policy",
+			policy:       "",
+			expectStatus: http.StatusForbidden,
+			expectWaf:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCalled := false
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafCalled = true
+				w.WriteHeader(http.StatusForbidden)
+			}))
+			defer modsecurityMockServer.Close()
+
+			health := newHealthChecker(&Config{HealthCheckIntervalMillis: 1000, UnhealthyPolicy: tt.policy})
+			health.healthy = 0
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				health:         health,
+				retryAfter:     1,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectWaf, wafCalled)
+		})
+	}
+}
+
+func TestModsecurity_ServeHTTP_HealthPath(t *testing.T) {
+	health := newHealthChecker(&Config{HealthCheckIntervalMillis: 1000})
+	middleware := &Modsecurity{
+		next:       http.NotFoundHandler(),
+		health:     health,
+		healthPath: "/waf/health",
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/waf/health", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"status": "healthy"}`, rw.Body.String())
+
+	atomic.StoreInt32(&health.healthy, 0)
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/waf/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.JSONEq(t, `{"status": "unhealthy"}`, rw.Body.String())
+}
+
+func TestNew_HealthPathWithoutHealthCheck(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf"
+	config.HealthPath = "/waf/health"
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
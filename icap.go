@@ -0,0 +1,277 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	icapScanBody  = "body"
+	icapScanFiles = "files"
+
+	icapFailureReject = "reject"
+	icapFailureBypass = "bypass"
+
+	icapDefaultPort = "1344"
+)
+
+// icapScanner sends the request bodies, or the files of multipart uploads,
+// to an ICAP (RFC 3507) antivirus service with REQMOD.
+type icapScanner struct {
+	address       string
+	serviceUrl    string
+	scan          string
+	timeout       time.Duration
+	failurePolicy string
+	status        int
+}
+
+func newICAPScanner(config *Config) (*icapScanner, error) {
+	if config.IcapUrl == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.IcapUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid icapUrl: %w", err)
+	}
+	if u.Scheme != "icap" {
+		return nil, fmt.Errorf("unsupported icapUrl scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), icapDefaultPort)
+	}
+
+	s := &icapScanner{
+		address:       u.Host,
+		serviceUrl:    u.String(),
+		scan:          config.IcapScan,
+		timeout:       millisOrDefault(config.IcapTimeoutMillis, 5*time.Second),
+		failurePolicy: config.IcapFailurePolicy,
+		status:        intOrDefault(config.IcapBlockStatus, http.StatusForbidden),
+	}
+
+	if !isErrorStatus(s.status) {
+		return nil, fmt.Errorf("unsupported icapBlockStatus %d", config.IcapBlockStatus)
+	}
+
+	switch s.scan {
+	case "":
+		s.scan = icapScanFiles
+	case icapScanBody, icapScanFiles:
+	default:
+		return nil, fmt.Errorf("unsupported icapScan %q", config.IcapScan)
+	}
+
+	switch s.failurePolicy {
+	case "":
+		s.failurePolicy = icapFailureReject
+	case icapFailureReject, icapFailureBypass:
+	default:
+		return nil, fmt.Errorf("unsupported icapFailurePolicy %q", config.IcapFailurePolicy)
+	}
+	return s, nil
+}
+
+// icapInfected scans the body and answers the request when it is infected,
+// or when the scan failed and the failure policy rejects the request.
+func (a *Modsecurity) icapInfected(rw http.ResponseWriter, req *http.Request, body []byte) bool {
+	if a.icap == nil || len(body) == 0 {
+		return false
+	}
+
+	threat, err := a.icap.scanRequest(req, body)
+	if err != nil {
+		if req.Context().Err() != nil {
+			a.clientGone(rw, req)
+			return true
+		}
+		a.metrics.inc("icap_error")
+		a.logger.Printf("fail to scan %s %s with icap: %s", req.Method, req.URL.Path, err.Error())
+		if a.icap.failurePolicy == icapFailureBypass {
+			a.metrics.inc("icap_bypassed")
+			return false
+		}
+		a.emit(a.newEvent(req, eventActionError, "icap: "+err.Error(), http.StatusBadGateway))
+		http.Error(rw, "", http.StatusBadGateway)
+		return true
+	}
+
+	if threat == "" {
+		a.metrics.inc("icap_clean")
+		return false
+	}
+	a.metrics.inc("icap_infected")
+	a.logger.Printf("icap found %s in %s %s", threat, req.Method, req.URL.Path)
+	a.emit(a.newEvent(req, eventActionBlock, "icap "+threat, a.icap.status))
+	http.Error(rw, "", a.icap.status)
+	return true
+}
+
+// scanRequest returns the first threat found in the body, or in the files
+// of a multipart upload. Malformed multipart bodies are scanned as a whole.
+func (s *icapScanner) scanRequest(req *http.Request, body []byte) (string, error) {
+	ctx := req.Context()
+	if s.scan == icapScanFiles {
+		if !isMultipart(req) {
+			return "", nil
+		}
+		if files, ok := multipartFiles(req, body); ok {
+			for _, f := range files {
+				threat, err := s.scanContent(ctx, req, f.content, f.header)
+				if err != nil || threat != "" {
+					return threat, err
+				}
+			}
+			return "", nil
+		}
+	}
+	return s.scanContent(ctx, req, body, req.Header)
+}
+
+type multipartFile struct {
+	header  http.Header
+	content []byte
+}
+
+func isMultipart(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// multipartFiles returns the file parts of a multipart body, and false when
+// the body is not a well formed multipart body.
+func multipartFiles(req *http.Request, body []byte) ([]multipartFile, bool) {
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return nil, false
+	}
+
+	var files []multipartFile
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, true
+		}
+		if err != nil {
+			return nil, false
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, false
+		}
+		header := make(http.Header)
+		header.Set("Content-Type", part.Header.Get("Content-Type"))
+		header.Set("Content-Disposition", part.Header.Get("Content-Disposition"))
+		files = append(files, multipartFile{header: header, content: content})
+	}
+}
+
+// scanContent sends one REQMOD request and returns the threat reported by
+// the ICAP server, if any.
+func (s *icapScanner) scanContent(ctx context.Context, req *http.Request, content []byte, header http.Header) (string, error) {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// the encapsulated HTTP request only carries what the antivirus needs
+	var httpHeader bytes.Buffer
+	fmt.Fprintf(&httpHeader, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	for _, k := range []string{"Content-Type", "Content-Disposition"} {
+		if v := header.Get(k); v != "" {
+			fmt.Fprintf(&httpHeader, "%s: %s\r\n", k, v)
+		}
+	}
+	fmt.Fprintf(&httpHeader, "Content-Length: %d\r\n\r\n", len(content))
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "REQMOD %s ICAP/1.0\r\n", s.serviceUrl)
+	fmt.Fprintf(w, "Host: %s\r\n", s.address)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: req-hdr=0, req-body=%d\r\n\r\n", httpHeader.Len())
+	w.Write(httpHeader.Bytes())
+	chunked := httputil.NewChunkedWriter(w)
+	chunked.Write(content)
+	chunked.Close()
+	w.WriteString("\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return "", fmt.Errorf("fail to read icap response: %w", err)
+	}
+	icapHeader, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return "", fmt.Errorf("fail to read icap response: %w", err)
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return "", fmt.Errorf("malformed icap status line %q", statusLine)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed icap status line %q", statusLine)
+	}
+
+	switch {
+	case status == http.StatusNoContent:
+		return "", nil
+	case status != http.StatusOK:
+		return "", fmt.Errorf("icap server answered %d", status)
+	}
+
+	if infection := icapHeader.Get("X-Infection-Found"); infection != "" {
+		return icapThreat(infection), nil
+	}
+	if violation := icapHeader.Get("X-Violations-Found"); violation != "" {
+		return "violation", nil
+	}
+	// a server answering with an HTTP response instead of the request
+	// refuses the content
+	if strings.Contains(icapHeader.Get("Encapsulated"), "res-hdr") {
+		return "blocked", nil
+	}
+	return "", nil
+}
+
+// icapThreat extracts the threat name of an X-Infection-Found header, such
+// as "Type=0; Resolution=2; Threat=Eicar-Test-Signature;".
+func icapThreat(infection string) string {
+	for _, field := range strings.Split(infection, ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "Threat=") {
+			return strings.TrimPrefix(field, "Threat=")
+		}
+	}
+	return "infected"
+}
@@ -0,0 +1,275 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeICAP answers REQMOD requests like c-icap with ClamAV: 204 for clean
+// content, 200 with an HTTP 403 response for the EICAR test file.
+type fakeICAP struct {
+	listener net.Listener
+	status   int
+
+	mu       sync.Mutex
+	requests []string
+	bodies   []string
+}
+
+func newFakeICAP(t *testing.T) *fakeICAP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeICAP{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeICAP) url() string {
+	return "icap://" + f.listener.Addr().String() + "/srv_clamav"
+}
+
+func (f *fakeICAP) handle(conn net.Conn) {
+	defer conn.Close()
+	buffered := bufio.NewReader(conn)
+	reader := textproto.NewReader(buffered)
+
+	requestLine, err := reader.ReadLine()
+	if err != nil {
+		return
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+
+	// Encapsulated: req-hdr=0, req-body=<length of the HTTP header>
+	encapsulated := header.Get("Encapsulated")
+	bodyOffset, _ := strconv.Atoi(encapsulated[strings.LastIndex(encapsulated, "=")+1:])
+	httpHeader := make([]byte, bodyOffset)
+	if _, err := io.ReadFull(buffered, httpHeader); err != nil {
+		return
+	}
+	body, err := io.ReadAll(httputil.NewChunkedReader(buffered))
+	if err != nil {
+		return
+	}
+	buffered.ReadString('\n')
+
+	f.mu.Lock()
+	f.requests = append(f.requests, requestLine)
+	f.bodies = append(f.bodies, string(body))
+	status := f.status
+	f.mu.Unlock()
+
+	switch {
+	case status != 0:
+		io.WriteString(conn, "ICAP/1.0 "+strconv.Itoa(status)+" Server Error\r\nISTag: \"fake\"\r\nEncapsulated: null-body=0\r\n\r\n")
+	case strings.Contains(string(body), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"):
+		res := "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+		io.WriteString(conn, "ICAP/1.0 200 OK\r\nISTag: \"fake\"\r\n"+
+			"X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;\r\n"+
+			"Encapsulated: res-hdr=0, null-body="+strconv.Itoa(len(res))+"\r\n\r\n"+res)
+	default:
+		io.WriteString(conn, "ICAP/1.0 204 No Content\r\nISTag: \"fake\"\r\nEncapsulated: null-body=0\r\n\r\n")
+	}
+}
+
+func multipartUpload(t *testing.T, fields map[string]string, files map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	for name, content := range files {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, content)
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func TestModsecurity_ServeHTTP_ICAP(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name           string
+		scan           string
+		fields         map[string]string
+		files          map[string]string
+		rawBody        string
+		expectedStatus int
+		expectedScans  []string
+	}{
+		{
+			name:           "Clean upload",
+			files:          map[string]string{"report.txt": "quarterly numbers"},
+			expectedStatus: http.StatusOK,
+			expectedScans:  []string{"quarterly numbers"},
+		},
+		{
+			name:           "Infected upload",
+			fields:         map[string]string{"comment": "hello"},
+			files:          map[string]string{"eicar.com": eicar},
+			expectedStatus: http.StatusForbidden,
+			expectedScans:  []string{eicar},
+		},
+		{
+			name:           "Form fields are not scanned",
+			fields:         map[string]string{"comment": eicar},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Plain body is not scanned in files mode",
+			rawBody:        eicar,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Plain body in body mode",
+			scan:           icapScanBody,
+			rawBody:        eicar,
+			expectedStatus: http.StatusForbidden,
+			expectedScans:  []string{eicar},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			icapServer := newFakeICAP(t)
+			scanner, err := newICAPScanner(&Config{IcapUrl: icapServer.url(), IcapScan: tt.scan})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				icap:           scanner,
+			}
+
+			var req *http.Request
+			if tt.rawBody != "" {
+				req = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.rawBody))
+				req.Header.Set("Content-Type", "application/octet-stream")
+			} else {
+				body, contentType := multipartUpload(t, tt.fields, tt.files)
+				req = httptest.NewRequest(http.MethodPost, "/upload", body)
+				req.Header.Set("Content-Type", contentType)
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			icapServer.mu.Lock()
+			defer icapServer.mu.Unlock()
+			assert.Equal(t, tt.expectedScans, icapServer.bodies)
+			for _, line := range icapServer.requests {
+				assert.Equal(t, "REQMOD "+icapServer.url()+" ICAP/1.0", line)
+			}
+		})
+	}
+}
+
+func TestModsecurity_ServeHTTP_ICAPFailurePolicy(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name           string
+		policy         string
+		serverStatus   int
+		down           bool
+		expectedStatus int
+	}{
+		{name: "Server error rejects", serverStatus: 500, expectedStatus: http.StatusBadGateway},
+		{name: "Server down rejects", down: true, expectedStatus: http.StatusBadGateway},
+		{name: "Server error bypasses", policy: icapFailureBypass, serverStatus: 500, expectedStatus: http.StatusOK},
+		{name: "Server down bypasses", policy: icapFailureBypass, down: true, expectedStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			icapServer := newFakeICAP(t)
+			icapServer.status = tt.serverStatus
+			if tt.down {
+				icapServer.listener.Close()
+			}
+			scanner, err := newICAPScanner(&Config{IcapUrl: icapServer.url(), IcapScan: icapScanBody, IcapFailurePolicy: tt.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				icap:           scanner,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("content")))
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			assert.Equal(t, int64(1), middleware.metrics.get("icap_error"))
+		})
+	}
+}
+
+func TestIcapThreat(t *testing.T) {
+	assert.Equal(t, "Eicar-Test-Signature", icapThreat("Type=0; Resolution=2; Threat=Eicar-Test-Signature;"))
+	assert.Equal(t, "infected", icapThreat("Type=0; Resolution=2;"))
+}
+
+func TestNewICAPScanner_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Unknown scheme", config: Config{IcapUrl: "http://c-icap:1344/srv_clamav"}},
+		{name: "Unknown scan", config: Config{IcapUrl: "icap://c-icap/srv_clamav", IcapScan: "headers"}},
+		{name: "Unknown failure policy", config: Config{IcapUrl: "icap://c-icap/srv_clamav", IcapFailurePolicy: "retry"}},
+		{name: "Invalid block status", config: Config{IcapUrl: "icap://c-icap/srv_clamav", IcapBlockStatus: 42}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newICAPScanner(&tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
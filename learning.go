@@ -0,0 +1,300 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	uuidSegment  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	intSegment   = regexp.MustCompile(`^[0-9]+$`)
+	hexSegment   = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	tokenSegment = regexp.MustCompile(`^[A-Za-z0-9_-]{20,}$`)
+	hasDigit     = regexp.MustCompile(`[0-9]`)
+
+	// only names and segments made of these characters end up in the
+	// suggested rules, so that a client cannot inject SecRule syntax
+	safeArgName     = regexp.MustCompile(`^[A-Za-z0-9_.\-\[\]]+$`)
+	safePathSegment = regexp.MustCompile(`^[A-Za-z0-9_.\-~]*$`)
+
+	secRuleEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// pathPlaceholders are the dynamic segments collapsed by pathPattern, with
+// the regular expression they stand for in the exported rules.
+var pathPlaceholders = []struct {
+	name    string
+	segment *regexp.Regexp
+	rx      string
+}{
+	{"{int}", intSegment, "[0-9]+"},
+	{"{uuid}", uuidSegment, "[0-9a-fA-F-]{36}"},
+	{"{hex}", hexSegment, "[0-9a-fA-F]+"},
+	{"{token}", tokenSegment, "[A-Za-z0-9_-]+"},
+}
+
+// learnKey is one suggested exclusion: rule ruleID should not inspect
+// target on the paths matching pattern. An empty target removes the rule.
+type learnKey struct {
+	pattern string
+	target  string
+	ruleID  string
+}
+
+// learner records the rules blocking requests during a window, to suggest
+// CRS exclusions for the false positives.
+type learner struct {
+	until       time.Time
+	maxEntries  int
+	ruleIDStart int
+	// allowed are the clients reading the exclusions, nil for any
+	allowed *cidrTrie
+
+	mu   sync.Mutex
+	hits map[learnKey]int64
+}
+
+func newLearner(config *Config) (*learner, error) {
+	if config.LearningPath == "" {
+		return nil, nil
+	}
+	l := &learner{
+		until:       time.Now().Add(millisOrDefault(config.LearningWindowMillis, 24*time.Hour)),
+		maxEntries:  intOrDefault(config.LearningMaxEntries, 10000),
+		ruleIDStart: intOrDefault(config.LearningRuleIdStart, 10000),
+		hits:        make(map[learnKey]int64),
+	}
+	for _, value := range config.LearningAllowedNetworks {
+		network, ok := parseNetwork(value)
+		if !ok {
+			return nil, fmt.Errorf("unsupported learningAllowedNetworks %q", value)
+		}
+		if l.allowed == nil {
+			l.allowed = &cidrTrie{}
+		}
+		l.allowed.insert(network)
+	}
+	return l, nil
+}
+
+// serves reports whether req reads the exclusions. Other clients go through
+// the middleware as for any path.
+func (l *learner) serves(req *http.Request) bool {
+	return l.allowed == nil || l.allowed.contains(net.ParseIP(clientIP(req)))
+}
+
+// learn records the rules of a WAF block against the parameters of the
+// request. Which parameter matched is not known, so every parameter is a
+// candidate and the hit counts tell the false positives apart.
+func (a *Modsecurity) learn(req *http.Request, body []byte, resp *http.Response) {
+	if a.learning == nil || resp.StatusCode < 400 || time.Now().After(a.learning.until) {
+		return
+	}
+
+	verdict := a.parseVerdict(resp)
+	// the exempted blocks are already taken care of
+	if a.exempted(req, verdict) {
+		return
+	}
+
+	var ruleIDs []string
+	for _, id := range verdict.ruleIDs {
+		if !isScoreEvaluationRule(id) {
+			ruleIDs = append(ruleIDs, id)
+		}
+	}
+	if len(ruleIDs) == 0 {
+		a.metrics.inc("learning_unattributed")
+		return
+	}
+
+	pattern, ok := pathPattern(req.URL.Path)
+	if !ok {
+		a.metrics.inc("learning_unsafe")
+		return
+	}
+	targets, unsafe := requestArgs(req, body)
+	if unsafe > 0 {
+		a.metrics.add("learning_unsafe", int64(unsafe))
+	}
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+
+	a.learning.mu.Lock()
+	defer a.learning.mu.Unlock()
+	for _, id := range ruleIDs {
+		for _, target := range targets {
+			key := learnKey{pattern: pattern, target: target, ruleID: id}
+			if _, ok := a.learning.hits[key]; !ok && len(a.learning.hits) >= a.learning.maxEntries {
+				a.metrics.inc("learning_dropped")
+				continue
+			}
+			a.learning.hits[key]++
+		}
+	}
+}
+
+// requestArgs returns the ModSecurity ARGS targets of the query string and
+// of the form bodies, and the number of names skipped as unsafe.
+func requestArgs(req *http.Request, body []byte) ([]string, int) {
+	names := make(map[string]bool)
+	for name := range req.URL.Query() {
+		names[name] = true
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			for name := range values {
+				names[name] = true
+			}
+		}
+	case "multipart/form-data":
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			if part.FormName() != "" && part.FileName() == "" {
+				names[part.FormName()] = true
+			}
+		}
+	}
+
+	targets := make([]string, 0, len(names))
+	unsafe := 0
+	for name := range names {
+		if !safeArgName.MatchString(name) {
+			unsafe++
+			continue
+		}
+		targets = append(targets, "ARGS:"+name)
+	}
+	sort.Strings(targets)
+	return targets, unsafe
+}
+
+// pathPattern collapses the dynamic segments of path, such as numeric IDs
+// or UUIDs, so that the blocks on /users/1 and /users/2 add up. It is false
+// when a segment holds unsafe characters.
+func pathPattern(path string) (string, bool) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !safePathSegment.MatchString(segment) {
+			return "", false
+		}
+		for _, p := range pathPlaceholders {
+			if p.segment.MatchString(segment) && (p.name == "{int}" || hasDigit.MatchString(segment)) {
+				segments[i] = p.name
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// patternOperator returns the SecRule operator matching REQUEST_FILENAME
+// against a path pattern. The dots are put in classes rather than escaped,
+// as the quoted operator is escaped again.
+func patternOperator(pattern string) string {
+	if !strings.Contains(pattern, "{") {
+		return "@streq " + pattern
+	}
+	rx := strings.ReplaceAll(pattern, ".", "[.]")
+	for _, p := range pathPlaceholders {
+		rx = strings.ReplaceAll(rx, p.name, p.rx)
+	}
+	return "@rx ^" + rx + "$"
+}
+
+type learnedExclusion struct {
+	Path      string `json:"path"`
+	Parameter string `json:"parameter,omitempty"`
+	RuleID    string `json:"ruleId"`
+	Hits      int64  `json:"hits"`
+}
+
+// exclusions returns the recorded tuples, the most frequent first.
+func (l *learner) exclusions() []learnedExclusion {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]learnedExclusion, 0, len(l.hits))
+	for k, hits := range l.hits {
+		list = append(list, learnedExclusion{Path: k.pattern, Parameter: k.target, RuleID: k.ruleID, Hits: hits})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Hits != list[j].Hits {
+			return list[i].Hits > list[j].Hits
+		}
+		if list[i].Path != list[j].Path {
+			return list[i].Path < list[j].Path
+		}
+		if list[i].RuleID != list[j].RuleID {
+			return list[i].RuleID < list[j].RuleID
+		}
+		return list[i].Parameter < list[j].Parameter
+	})
+	return list
+}
+
+// secRules formats the exclusions as one SecRule per path pattern, to be
+// reviewed before being added to the CRS configuration.
+func (l *learner) secRules() string {
+	exclusions := l.exclusions()
+
+	var paths []string
+	byPath := make(map[string][]learnedExclusion)
+	for _, e := range exclusions {
+		if _, ok := byPath[e.Path]; !ok {
+			paths = append(paths, e.Path)
+		}
+		byPath[e.Path] = append(byPath[e.Path], e)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %d exclusions suggested from the WAF blocks, review them before use\n", len(exclusions))
+	for i, path := range paths {
+		var actions []string
+		b.WriteString("\n")
+		for _, e := range byPath[path] {
+			target := "every parameter"
+			action := "ctl:ruleRemoveById=" + e.RuleID
+			if e.Parameter != "" {
+				target = e.Parameter
+				action = "ctl:ruleRemoveTargetById=" + e.RuleID + ";" + e.Parameter
+			}
+			fmt.Fprintf(&b, "# %d hits: rule %s on %s\n", e.Hits, e.RuleID, target)
+			actions = append(actions, action)
+		}
+		fmt.Fprintf(&b, "SecRule REQUEST_FILENAME \"%s\" \\\n    \"id:%d,phase:1,pass,nolog,%s\"\n",
+			secRuleEscaper.Replace(patternOperator(path)), l.ruleIDStart+i, strings.Join(actions, ","))
+	}
+	return b.String()
+}
+
+// serveLearning writes the suggested exclusions, as SecRule snippets or as
+// JSON with ?format=json.
+func (a *Modsecurity) serveLearning(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(a.learning.exclusions())
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write([]byte(a.learning.secRules()))
+}
@@ -0,0 +1,164 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPattern(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/api/search", expected: "/api/search"},
+		{path: "/users/42/orders", expected: "/users/{int}/orders"},
+		{path: "/files/3f2504e0-4f89-11d3-9a0c-0305e82c3301", expected: "/files/{uuid}"},
+		{path: "/commits/9fceb02d0ae598e95dc970b74767f19372d61af8", expected: "/commits/{hex}"},
+		{path: "/reset/aZ3kX9_qL2mN8pR4tV6wY1", expected: "/reset/{token}"},
+		{path: "/administration_settings_page", expected: "/administration_settings_page"},
+		{path: `/a" "id:1,phase:1,ctl:ruleEngine=Off`, expected: ""},
+		{path: "/files/a b.txt", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			pattern, ok := pathPattern(tt.path)
+			assert.Equal(t, tt.expected, pattern)
+			assert.Equal(t, tt.expected != "", ok)
+		})
+	}
+
+	assert.Equal(t, `@rx ^/users/[0-9]+/orders[.]json$`, patternOperator("/users/{int}/orders.json"))
+	assert.Equal(t, "@streq /api/search", patternOperator("/api/search"))
+}
+
+func TestModsecurity_ServeHTTP_Learning(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "" || r.Method == http.MethodPost {
+			w.Header().Set("X-Waf-Rule-Ids", "942100, 949110")
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer modsecurityMockServer.Close()
+
+	middleware := &Modsecurity{
+		next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		modSecurityUrl: modsecurityMockServer.URL,
+		maxBodySize:    1024,
+		httpClient:     http.DefaultClient,
+		logger:         log.New(io.Discard, "", log.LstdFlags),
+		ruleIDsHeader:  defaultRuleIDsHeader,
+		learning:       &learner{until: time.Now().Add(time.Hour), maxEntries: 100, ruleIDStart: 10000, hits: make(map[learnKey]int64)},
+		learningPath:   "/waf/learning",
+	}
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/users/12/search?q=select+1", nil),
+		httptest.NewRequest(http.MethodGet, "/users/13/search?q=select+2&page=1", nil),
+		httptest.NewRequest(http.MethodGet, "/users/13/search?page=1", nil),
+		httptest.NewRequest(http.MethodPost, "/upload", nil),
+	}
+	login := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("user=admin'--&password=x"))
+	login.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	requests = append(requests, login)
+	for _, req := range requests {
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/waf/learning", nil))
+	assert.Equal(t, `# 5 exclusions suggested from the WAF blocks, review them before use
+
+# 2 hits: rule 942100 on ARGS:q
+# 1 hits: rule 942100 on ARGS:page
+SecRule REQUEST_FILENAME "@rx ^/users/[0-9]+/search$" \
+    "id:10000,phase:1,pass,nolog,ctl:ruleRemoveTargetById=942100;ARGS:q,ctl:ruleRemoveTargetById=942100;ARGS:page"
+
+# 1 hits: rule 942100 on ARGS:password
+# 1 hits: rule 942100 on ARGS:user
+SecRule REQUEST_FILENAME "@streq /login" \
+    "id:10001,phase:1,pass,nolog,ctl:ruleRemoveTargetById=942100;ARGS:password,ctl:ruleRemoveTargetById=942100;ARGS:user"
+
+# 1 hits: rule 942100 on every parameter
+SecRule REQUEST_FILENAME "@streq /upload" \
+    "id:10002,phase:1,pass,nolog,ctl:ruleRemoveById=942100"
+`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/waf/learning?format=json", nil))
+	var exclusions []learnedExclusion
+	if err := json.NewDecoder(rw.Body).Decode(&exclusions); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, learnedExclusion{Path: "/users/{int}/search", Parameter: "ARGS:q", RuleID: "942100", Hits: 2}, exclusions[0])
+
+	// nothing is recorded once the window is over
+	middleware.learning.until = time.Now().Add(-time.Second)
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other?q=1", nil))
+	assert.Len(t, middleware.learning.exclusions(), 5)
+}
+
+func TestModsecurity_ServeHTTP_LearningUnsafeInput(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Waf-Rule-Ids", "942100")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	learning, err := newLearner(&Config{LearningPath: "/waf/learning", LearningAllowedNetworks: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := &Modsecurity{
+		next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		modSecurityUrl: modsecurityMockServer.URL,
+		maxBodySize:    1024,
+		httpClient:     http.DefaultClient,
+		logger:         log.New(io.Discard, "", log.LstdFlags),
+		metrics:        newMetrics(),
+		ruleIDsHeader:  defaultRuleIDsHeader,
+		learning:       learning,
+		learningPath:   "/waf/learning",
+	}
+
+	for _, target := range []string{
+		"/a%22%20%22id:1,phase:1,ctl:ruleEngine=Off?x,ctl:ruleEngine%3DOff=1",
+		"/search?ids%5B%5D=1&x,ctl:ruleEngine%3DOff=1&q%22=1",
+	} {
+		middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	assert.Equal(t, int64(3), middleware.metrics.get("learning_unsafe"))
+
+	req := httptest.NewRequest(http.MethodGet, "/waf/learning", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, req)
+	assert.Equal(t, `# 1 exclusions suggested from the WAF blocks, review them before use
+
+# 1 hits: rule 942100 on ARGS:ids[]
+SecRule REQUEST_FILENAME "@streq /search" \
+    "id:10000,phase:1,pass,nolog,ctl:ruleRemoveTargetById=942100;ARGS:ids[]"
+`, rw.Body.String())
+
+	// the other clients go through the WAF as for any path
+	rw = httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/waf/learning", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestSecRules_EscapesOperator(t *testing.T) {
+	l := &learner{ruleIDStart: 1, hits: map[learnKey]int64{{pattern: `/a"\b`, ruleID: "942100"}: 1}}
+	assert.Contains(t, l.secRules(), `SecRule REQUEST_FILENAME "@streq /a\"\\b" \`)
+}
+
+func TestNewLearner_Errors(t *testing.T) {
+	_, err := newLearner(&Config{LearningPath: "/waf/learning", LearningAllowedNetworks: []string{"intranet"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	overflowReject     = "reject"
+	overflowBypass     = "bypass"
+	overflowBypassSafe = "bypass-safe"
+)
+
+// limiter bounds the number of concurrent WAF calls. Requests exceeding the
+// limit wait in a bounded queue for at most maxWait.
+type limiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	maxWait  time.Duration
+	queued   int64
+	metrics  *metrics
+}
+
+// newLimiter returns nil when the number of WAF calls is not limited.
+func newLimiter(config *Config, m *metrics) (*limiter, error) {
+	switch config.OverflowPolicy {
+	case "", overflowReject, overflowBypass, overflowBypassSafe:
+	default:
+		return nil, fmt.Errorf("unsupported overflowPolicy %q", config.OverflowPolicy)
+	}
+	if config.MaxConcurrentRequests <= 0 {
+		return nil, nil
+	}
+	return &limiter{
+		slots:    make(chan struct{}, config.MaxConcurrentRequests),
+		maxQueue: int64(config.MaxQueueSize),
+		maxWait:  time.Duration(config.MaxQueueWaitMillis) * time.Millisecond,
+		metrics:  m,
+	}, nil
+}
+
+// acquire returns true once a slot is available, and false if the queue is
+// full, the wait is too long or ctx is done.
+func (l *limiter) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.metrics.set("waf_inflight", int64(len(l.slots)))
+		return true
+	default:
+	}
+
+	if l.maxWait <= 0 {
+		return false
+	}
+	queued := atomic.AddInt64(&l.queued, 1)
+	if queued > l.maxQueue {
+		atomic.AddInt64(&l.queued, -1)
+		return false
+	}
+	l.metrics.set("waf_queue_depth", queued)
+	defer func() {
+		l.metrics.set("waf_queue_depth", atomic.AddInt64(&l.queued, -1))
+	}()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		l.metrics.set("waf_inflight", int64(len(l.slots)))
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+	l.metrics.set("waf_inflight", int64(len(l.slots)))
+}
+
+// shed applies the overflow policy to a request that did not get a slot. It
+// returns true if the request was answered, false if it must bypass the WAF.
+func (a *Modsecurity) shed(rw http.ResponseWriter, req *http.Request) bool {
+	a.metrics.inc("requests_shed")
+
+	if a.overflowPolicy == overflowBypass ||
+		(a.overflowPolicy == overflowBypassSafe && isSafeMethod(req.Method)) {
+		a.logger.Printf("too many concurrent requests to modsec, bypassing WAF for %s %s", req.Method, req.URL.Path)
+		a.metrics.inc("requests_shed_bypassed")
+		return false
+	}
+
+	a.logger.Printf("too many concurrent requests to modsec, rejecting %s %s", req.Method, req.URL.Path)
+	a.metrics.inc("requests_shed_rejected")
+	rw.Header().Set("Retry-After", strconv.Itoa(a.retryAfter))
+	http.Error(rw, "", http.StatusServiceUnavailable)
+	return true
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
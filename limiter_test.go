@@ -0,0 +1,137 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ServeHTTP_Overflow(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		method       string
+		expectStatus int
+		expectBody   string
+		expectMetric string
+	}{
+		{
+			name:         "Rejects overflow with 503",
+			policy:       overflowReject,
+			method:       http.MethodGet,
+			expectStatus: http.StatusServiceUnavailable,
+			expectBody:   "\n",
+			expectMetric: "requests_shed_rejected",
+		},
+		{
+			name:         "Bypasses WAF on overflow",
+			policy:       overflowBypass,
+			method:       http.MethodPost,
+			expectStatus: http.StatusOK,
+			expectBody:   "Response from service",
+			expectMetric: "requests_shed_bypassed",
+		},
+		{
+			name:         "Bypasses WAF on overflow for safe methods",
+			policy:       overflowBypassSafe,
+			method:       http.MethodGet,
+			expectStatus: http.StatusOK,
+			expectBody:   "Response from service",
+			expectMetric: "requests_shed_bypassed",
+		},
+		{
+			name:         "Rejects overflow for unsafe methods",
+			policy:       overflowBypassSafe,
+			method:       http.MethodPost,
+			expectStatus: http.StatusServiceUnavailable,
+			expectBody:   "\n",
+			expectMetric: "requests_shed_rejected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMetrics()
+			l, err := newLimiter(&Config{MaxConcurrentRequests: 1, OverflowPolicy: tt.policy}, m)
+			assert.NoError(t, err)
+
+			// hold the only slot as if a WAF call was in-flight
+			assert.True(t, l.acquire(context.Background()))
+			defer l.release()
+
+			middleware := &Modsecurity{
+				next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte("Response from service"))
+				}),
+				modSecurityUrl: "http://waf.invalid",
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        m,
+				limiter:        l,
+				overflowPolicy: tt.policy,
+				retryAfter:     5,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(tt.method, "/test", bytes.NewBufferString("Request")))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectBody, rw.Body.String())
+			assert.Equal(t, int64(1), m.get("requests_shed"))
+			assert.Equal(t, int64(1), m.get(tt.expectMetric))
+			if tt.expectStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, "5", rw.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestLimiter_Queue(t *testing.T) {
+	m := newMetrics()
+	l, err := newLimiter(&Config{MaxConcurrentRequests: 1, MaxQueueSize: 1, MaxQueueWaitMillis: 1000}, m)
+	assert.NoError(t, err)
+
+	assert.True(t, l.acquire(context.Background()))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.acquire(context.Background())
+	}()
+
+	// wait for the request to be queued, a second one overflows the queue
+	for m.get("waf_queue_depth") != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, l.acquire(context.Background()))
+
+	l.release()
+	assert.True(t, <-acquired)
+	assert.Equal(t, int64(0), m.get("waf_queue_depth"))
+	l.release()
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	l, err := newLimiter(&Config{MaxConcurrentRequests: 1, MaxQueueSize: 1, MaxQueueWaitMillis: 10}, nil)
+	assert.NoError(t, err)
+
+	assert.True(t, l.acquire(context.Background()))
+	assert.False(t, l.acquire(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.maxWait = time.Hour
+	assert.False(t, l.acquire(ctx))
+}
+
+func TestNewLimiter_InvalidPolicy(t *testing.T) {
+	_, err := newLimiter(&Config{OverflowPolicy: "drop"}, nil)
+	assert.Error(t, err)
+}
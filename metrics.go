@@ -0,0 +1,80 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics holds the counters and gauges of a middleware instance. A nil
+// *metrics is valid and discards everything.
+type metrics struct {
+	mu     sync.RWMutex
+	values map[string]*int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{values: make(map[string]*int64)}
+}
+
+func (m *metrics) value(name string) *int64 {
+	m.mu.RLock()
+	v, ok := m.values[name]
+	m.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok = m.values[name]; !ok {
+		v = new(int64)
+		m.values[name] = v
+	}
+	return v
+}
+
+func (m *metrics) inc(name string) {
+	m.add(name, 1)
+}
+
+func (m *metrics) add(name string, delta int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(m.value(name), delta)
+}
+
+func (m *metrics) set(name string, value int64) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(m.value(name), value)
+}
+
+func (m *metrics) get(name string) int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(m.value(name))
+}
+
+func (m *metrics) snapshot() map[string]int64 {
+	snapshot := make(map[string]int64)
+	if m == nil {
+		return snapshot
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, v := range m.values {
+		snapshot[name] = atomic.LoadInt64(v)
+	}
+	return snapshot
+}
+
+// serveStats writes the metrics of the middleware as a JSON object.
+func (a *Modsecurity) serveStats(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(a.metrics.snapshot())
+}
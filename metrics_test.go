@@ -0,0 +1,53 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.inc("requests_inspected")
+			}
+		}()
+	}
+	wg.Wait()
+	m.set("queue_depth", 3)
+
+	assert.Equal(t, map[string]int64{"requests_inspected": 1000, "queue_depth": 3}, m.snapshot())
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *metrics
+	m.inc("requests_inspected")
+
+	assert.Equal(t, int64(0), m.get("requests_inspected"))
+	assert.Empty(t, m.snapshot())
+}
+
+func TestModsecurity_ServeHTTP_Stats(t *testing.T) {
+	middleware := &Modsecurity{
+		next:      http.NotFoundHandler(),
+		metrics:   newMetrics(),
+		statsPath: "/waf/stats",
+	}
+	middleware.metrics.add("requests_shed", 2)
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/waf/stats", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"requests_shed": 2}`, rw.Body.String())
+}
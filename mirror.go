@@ -0,0 +1,92 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+const (
+	modeInline = "inline"
+	modeMirror = "mirror"
+)
+
+// mirror holds the requests waiting to be sent to the WAF in the background.
+type mirror struct {
+	jobs chan mirrorJob
+}
+
+type mirrorJob struct {
+	proxyReq *http.Request
+	body     []byte
+}
+
+// startMirror starts the workers sending mirrored requests, they stop when
+// ctx is done.
+func (a *Modsecurity) startMirror(ctx context.Context, workers int, queueSize int) {
+	a.mirror = &mirror{jobs: make(chan mirrorJob, queueSize)}
+	for i := 0; i < workers; i++ {
+		go a.runMirrorWorker(ctx)
+	}
+}
+
+// mirrorRequest queues a copy of req for inspection, or drops it when the
+// queue is full. It never blocks.
+func (a *Modsecurity) mirrorRequest(req *http.Request, body []byte) {
+	// the copy must outlive the client request, the client timeout applies
+	proxyReq, err := a.newWafRequest(context.Background(), req, body)
+	if err != nil {
+		a.logger.Printf("mirror: fail to prepare forwarded request: %s", err.Error())
+		a.metrics.inc("mirror_error")
+		return
+	}
+
+	select {
+	case a.mirror.jobs <- mirrorJob{proxyReq: proxyReq, body: body}:
+		a.metrics.set("mirror_queue_depth", int64(len(a.mirror.jobs)))
+	default:
+		a.metrics.inc("mirror_dropped")
+	}
+}
+
+func (a *Modsecurity) runMirrorWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-a.mirror.jobs:
+			a.metrics.set("mirror_queue_depth", int64(len(a.mirror.jobs)))
+			a.sendMirror(job)
+		}
+	}
+}
+
+// sendMirror sends a mirrored request and records the verdict. The response
+// to the client has already been sent, so the verdict is only logged.
+func (a *Modsecurity) sendMirror(job mirrorJob) {
+	proxyReq := job.proxyReq
+	a.signRequest(proxyReq, job.body)
+
+	resp, err := a.httpClient.Do(proxyReq)
+	if err != nil {
+		a.logger.Printf("mirror: fail to send HTTP request to modsec: %s", err.Error())
+		a.metrics.inc("mirror_error")
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	a.learn(proxyReq, job.body, resp)
+
+	if a.exempted(proxyReq, a.parseVerdict(resp)) {
+		a.logger.Printf("mirror: rule exemption overrides modsec block of %s %s", proxyReq.Method, proxyReq.URL.Path)
+		a.metrics.inc("exemption_overridden")
+		a.metrics.inc("mirror_allowed")
+		return
+	}
+	if resp.StatusCode >= 400 {
+		a.logger.Printf("mirror: modsec would have blocked %s %s with %d", proxyReq.Method, proxyReq.URL.Path, resp.StatusCode)
+		a.metrics.inc("mirror_blocked")
+		return
+	}
+	a.metrics.inc("mirror_allowed")
+}
@@ -0,0 +1,96 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMirrorMiddleware(ctx context.Context, wafURL string, workers int, queueSize int) *Modsecurity {
+	middleware := &Modsecurity{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Response from service"))
+		}),
+		modSecurityUrl: wafURL,
+		maxBodySize:    1024,
+		name:           "modsecurity-middleware",
+		httpClient:     http.DefaultClient,
+		logger:         log.New(io.Discard, "", log.LstdFlags),
+		metrics:        newMetrics(),
+	}
+	middleware.startMirror(ctx, workers, queueSize)
+	return middleware
+}
+
+func waitForMetric(t *testing.T, m *metrics, name string, value int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for m.get(name) != value {
+		if time.Now().After(deadline) {
+			t.Fatalf("metric %s is %d, expected %d", name, m.get(name), value)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestModsecurity_ServeHTTP_Mirror(t *testing.T) {
+	wafBodies := make(chan string, 1)
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		wafBodies <- string(body)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	middleware := newMirrorMiddleware(ctx, modsecurityMockServer.URL, 1, 10)
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/test?test=../etc", bytes.NewBufferString("Request")))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "Response from service", rw.Body.String())
+	assert.Equal(t, "Request", <-wafBodies)
+	waitForMetric(t, middleware.metrics, "mirror_blocked", 1)
+}
+
+func TestModsecurity_ServeHTTP_MirrorDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer modsecurityMockServer.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	middleware := newMirrorMiddleware(ctx, modsecurityMockServer.URL, 1, 1)
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		rw := httptest.NewRecorder()
+		middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	}
+
+	// one request in-flight, at most one queued, the others are dropped
+	assert.GreaterOrEqual(t, middleware.metrics.get("mirror_dropped"), int64(3))
+}
+
+func TestNew_InvalidMode(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "http://waf"
+	config.Mode = "shadow"
+
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
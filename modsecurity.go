@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -13,11 +12,200 @@ import (
 	"time"
 )
 
+// statusClientClosedRequest is the non standard status used by Traefik and
+// nginx when the client closed the connection before the response.
+const statusClientClosedRequest = 499
+
 // Config the plugin configuration.
 type Config struct {
 	TimeoutMillis  int64  `json:"timeoutMillis"`
 	ModSecurityUrl string `json:"modSecurityUrl,omitempty"`
 	MaxBodySize    int64  `json:"maxBodySize"`
+
+	// Transport tuning for the connections to the modsecurity container.
+	MaxIdleConns                int   `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost         int   `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost             int   `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeoutMillis       int64 `json:"idleConnTimeoutMillis,omitempty"`
+	DialTimeoutMillis           int64 `json:"dialTimeoutMillis,omitempty"`
+	ResponseHeaderTimeoutMillis int64 `json:"responseHeaderTimeoutMillis,omitempty"`
+	KeepAliveMillis             int64 `json:"keepAliveMillis,omitempty"`
+	HTTP2                       bool  `json:"http2,omitempty"`
+
+	// TLS settings for https:// modsecurity URLs. Certificates are either a
+	// path to a PEM file or an inline PEM block.
+	TLSCA         string `json:"tlsCA,omitempty"`
+	TLSCert       string `json:"tlsCert,omitempty"`
+	TLSKey        string `json:"tlsKey,omitempty"`
+	TLSServerName string `json:"tlsServerName,omitempty"`
+	TLSMinVersion string `json:"tlsMinVersion,omitempty"`
+
+	// Signature of the requests sent to the WAF: "bearer" or "hmac". The
+	// secret is read from a file or from an environment variable.
+	AuthMode       string `json:"authMode,omitempty"`
+	AuthSecretFile string `json:"authSecretFile,omitempty"`
+	AuthSecretEnv  string `json:"authSecretEnv,omitempty"`
+
+	// Percentage of the clients inspected by the WAF, the others go straight
+	// to the next handler.
+	SamplingRate                float64 `json:"samplingRate"`
+	SamplingCookie              string  `json:"samplingCookie,omitempty"`
+	SamplingAlwaysInspectBody   bool    `json:"samplingAlwaysInspectBody,omitempty"`
+	SamplingAlwaysInspectNonGet bool    `json:"samplingAlwaysInspectNonGet,omitempty"`
+
+	// Bound on the concurrent WAF calls, and what to do with the requests
+	// that cannot be queued: "reject", "bypass" or "bypass-safe".
+	MaxConcurrentRequests int    `json:"maxConcurrentRequests,omitempty"`
+	MaxQueueSize          int    `json:"maxQueueSize,omitempty"`
+	MaxQueueWaitMillis    int64  `json:"maxQueueWaitMillis,omitempty"`
+	OverflowPolicy        string `json:"overflowPolicy,omitempty"`
+	RetryAfterSeconds     int    `json:"retryAfterSeconds,omitempty"`
+
+	// Path answered by the middleware itself with its metrics in JSON.
+	StatsPath string `json:"statsPath,omitempty"`
+
+	// Policy applied to the WAF responses forwarded to the client when a
+	// request is blocked.
+	ResponseHeadersAllowlist []string `json:"responseHeadersAllowlist,omitempty"`
+	ResponseHeadersStrip     []string `json:"responseHeadersStrip,omitempty"`
+	MaxResponseBodySize      int64    `json:"maxResponseBodySize,omitempty"`
+
+	// Signed tokens letting trusted clients skip the WAF ("skip") or have
+	// their request inspected without being blocked ("detect").
+	BypassSecrets []string `json:"bypassSecrets,omitempty"`
+	BypassHeader  string   `json:"bypassHeader,omitempty"`
+	BypassMode    string   `json:"bypassMode,omitempty"`
+
+	// Local virtual patching rules evaluated before the WAF call.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// Mode of inspection: "inline" waits for the WAF verdict, "mirror" sends
+	// a copy of the request to the WAF in the background and only logs the
+	// verdict, "parallel" calls the WAF and the service at the same time.
+	Mode            string `json:"mode,omitempty"`
+	MirrorWorkers   int    `json:"mirrorWorkers,omitempty"`
+	MirrorQueueSize int    `json:"mirrorQueueSize,omitempty"`
+
+	// Methods for which the WAF and the service are called at the same time,
+	// the service response being held back until the WAF allows the request.
+	ParallelMethods         []string `json:"parallelMethods,omitempty"`
+	MaxBufferedResponseSize int64    `json:"maxBufferedResponseSize,omitempty"`
+
+	// Inspection of the headers before reading the body: "local" evaluates
+	// the rules that do not need the body, "waf" also sends the headers to
+	// the WAF.
+	PreCheck string `json:"preCheck,omitempty"`
+
+	// Background probe of the WAF. While it is unhealthy, requests are
+	// rejected or bypass the WAF according to unhealthyPolicy instead of
+	// waiting for the timeout. healthPath is answered by the middleware with
+	// the WAF health.
+	HealthCheckIntervalMillis     int64  `json:"healthCheckIntervalMillis,omitempty"`
+	HealthCheckPath               string `json:"healthCheckPath,omitempty"`
+	HealthCheckExpectedStatus     int    `json:"healthCheckExpectedStatus,omitempty"`
+	HealthCheckTimeoutMillis      int64  `json:"healthCheckTimeoutMillis,omitempty"`
+	HealthCheckUnhealthyThreshold int    `json:"healthCheckUnhealthyThreshold,omitempty"`
+	UnhealthyPolicy               string `json:"unhealthyPolicy,omitempty"`
+	HealthPath                    string `json:"healthPath,omitempty"`
+
+	// Canary requests checking that the WAF still blocks a malicious request
+	// and allows a benign one, at startup and then every interval.
+	SelfTestIntervalMillis int64  `json:"selfTestIntervalMillis,omitempty"`
+	SelfTestMaliciousPath  string `json:"selfTestMaliciousPath,omitempty"`
+	SelfTestBenignPath     string `json:"selfTestBenignPath,omitempty"`
+	SelfTestTimeoutMillis  int64  `json:"selfTestTimeoutMillis,omitempty"`
+	SelfTestRefuseTraffic  bool   `json:"selfTestRefuseTraffic,omitempty"`
+
+	// Block and error events POSTed as JSON batches to a webhook.
+	WebhookUrl                 string `json:"webhookUrl,omitempty"`
+	WebhookSecret              string `json:"webhookSecret,omitempty"`
+	WebhookBatchSize           int    `json:"webhookBatchSize,omitempty"`
+	WebhookFlushIntervalMillis int64  `json:"webhookFlushIntervalMillis,omitempty"`
+	WebhookBufferSize          int    `json:"webhookBufferSize,omitempty"`
+	WebhookMaxRetries          int    `json:"webhookMaxRetries,omitempty"`
+	WebhookTimeoutMillis       int64  `json:"webhookTimeoutMillis,omitempty"`
+
+	// Headers of the WAF response carrying the matched rule IDs and the
+	// anomaly score, they are never forwarded to the client.
+	RuleIDsHeader string `json:"ruleIdsHeader,omitempty"`
+	ScoreHeader   string `json:"scoreHeader,omitempty"`
+
+	// Block and error events sent to a syslog server, formatted as CEF or
+	// LEEF. The address is udp://, tcp:// or tls://host:port.
+	SyslogAddress    string `json:"syslogAddress,omitempty"`
+	SyslogFacility   string `json:"syslogFacility,omitempty"`
+	SyslogFormat     string `json:"syslogFormat,omitempty"`
+	SyslogAppName    string `json:"syslogAppName,omitempty"`
+	SyslogTLSCA      string `json:"syslogTlsCA,omitempty"`
+	SyslogBufferSize int    `json:"syslogBufferSize,omitempty"`
+
+	// CrowdSec local API. Ban decisions are pulled from the stream with the
+	// bouncer API key; with machine credentials, the WAF blocks are pushed
+	// back as alerts.
+	CrowdsecLapiUrl              string `json:"crowdsecLapiUrl,omitempty"`
+	CrowdsecApiKey               string `json:"crowdsecApiKey,omitempty"`
+	CrowdsecUpdateIntervalMillis int64  `json:"crowdsecUpdateIntervalMillis,omitempty"`
+	CrowdsecTimeoutMillis        int64  `json:"crowdsecTimeoutMillis,omitempty"`
+	CrowdsecBanStatus            int    `json:"crowdsecBanStatus,omitempty"`
+	CrowdsecMachineId            string `json:"crowdsecMachineId,omitempty"`
+	CrowdsecPassword             string `json:"crowdsecPassword,omitempty"`
+	CrowdsecSignalBufferSize     int    `json:"crowdsecSignalBufferSize,omitempty"`
+
+	// ICAP antivirus scanning of the request bodies ("body") or of the files
+	// of multipart uploads ("files"), e.g. icap://c-icap:1344/srv_clamav.
+	// When the scan fails, the request is rejected or bypasses the scan
+	// according to icapFailurePolicy.
+	IcapUrl           string `json:"icapUrl,omitempty"`
+	IcapScan          string `json:"icapScan,omitempty"`
+	IcapTimeoutMillis int64  `json:"icapTimeoutMillis,omitempty"`
+	IcapFailurePolicy string `json:"icapFailurePolicy,omitempty"`
+	IcapBlockStatus   int    `json:"icapBlockStatus,omitempty"`
+
+	// External policy endpoint, such as the OPA data API, taking the final
+	// decision from the request attributes and the WAF verdict. When it
+	// fails, policyFailurePolicy keeps the WAF verdict ("waf"), allows or
+	// denies the request.
+	PolicyUrl            string   `json:"policyUrl,omitempty"`
+	PolicyHeaders        []string `json:"policyHeaders,omitempty"`
+	PolicyTimeoutMillis  int64    `json:"policyTimeoutMillis,omitempty"`
+	PolicyFailurePolicy  string   `json:"policyFailurePolicy,omitempty"`
+	PolicyCacheTTLMillis int64    `json:"policyCacheTtlMillis,omitempty"`
+	PolicyCacheSize      int      `json:"policyCacheSize,omitempty"`
+
+	// Local lists of malicious IPs and ranges, checked before anything else.
+	// The files are checked every interval and parsed again when changed.
+	ThreatFeeds             []ThreatFeed `json:"threatFeeds,omitempty"`
+	ThreatFeedsReloadMillis int64        `json:"threatFeedsReloadMillis,omitempty"`
+
+	// Learning of the rule exclusions: the rules blocking requests are
+	// recorded during the window and suggested as SecRule exclusions at
+	// learningPath.
+	LearningPath         string `json:"learningPath,omitempty"`
+	LearningWindowMillis int64  `json:"learningWindowMillis,omitempty"`
+	LearningMaxEntries   int    `json:"learningMaxEntries,omitempty"`
+	LearningRuleIdStart  int    `json:"learningRuleIdStart,omitempty"`
+	// Clients allowed to read learningPath, any client when empty.
+	LearningAllowedNetworks []string `json:"learningAllowedNetworks,omitempty"`
+
+	// WAF rules ignored on some paths. The WAF must report the matched rule
+	// IDs in ruleIdsHeader.
+	RuleExemptions []RuleExemption `json:"ruleExemptions,omitempty"`
+
+	// Protocol checks run before the WAF call, by name or "all". The
+	// method-not-allowed check accepts allowedMethods, the standard methods
+	// by default.
+	ProtocolChecks []string `json:"protocolChecks,omitempty"`
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+
+	// Limits on the request line and the headers, checked before the body is
+	// buffered. Zero disables a limit.
+	MaxUriLength       int `json:"maxUriLength,omitempty"`
+	MaxQueryLength     int `json:"maxQueryLength,omitempty"`
+	MaxArgCount        int `json:"maxArgCount,omitempty"`
+	MaxHeaderCount     int `json:"maxHeaderCount,omitempty"`
+	MaxHeaderSize      int `json:"maxHeaderSize,omitempty"`
+	MaxTotalHeaderSize int `json:"maxTotalHeaderSize,omitempty"`
+	MaxCookieCount     int `json:"maxCookieCount,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -27,7 +215,8 @@ func CreateConfig() *Config {
 		// Safe default: if the max body size was not specified, use 10MB
 		// Note that this will break any file upload with files > 10MB. Hopefully
 		// the user will configure this parameter during the installation.
-		MaxBodySize: 10 * 1024 * 1024,
+		MaxBodySize:  10 * 1024 * 1024,
+		SamplingRate: 100,
 	}
 }
 
@@ -39,6 +228,35 @@ type Modsecurity struct {
 	name           string
 	httpClient     *http.Client
 	logger         *log.Logger
+	authMode       string
+	authSecret     []byte
+	sampler        *sampler
+	metrics        *metrics
+	limiter        *limiter
+	overflowPolicy string
+	retryAfter     int
+	statsPath      string
+	responsePolicy *responsePolicy
+	bypass         *bypassVerifier
+	rules          []*rule
+	mirror         *mirror
+	parallel       *parallel
+	preCheck       string
+	health         *healthChecker
+	healthPath     string
+	selfTest       *selfTest
+	sinks          []eventSink
+	ruleIDsHeader  string
+	scoreHeader    string
+	crowdsec       *crowdsecBouncer
+	icap           *icapScanner
+	policy         *policyClient
+	feeds          *threatFeeds
+	learning       *learner
+	learningPath   string
+	exemptions     []*ruleExemption
+	protocol       *protocolChecker
+	requestLimits  []requestLimit
 }
 
 // New created a new Modsecurity plugin.
@@ -55,17 +273,215 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		timeout = time.Duration(config.TimeoutMillis) * time.Millisecond
 	}
 
-	return &Modsecurity{
-		modSecurityUrl: config.ModSecurityUrl,
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	authSecret, err := loadAuthSecret(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler, err := newSampler(config)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := newMetrics()
+	limiter, err := newLimiter(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	bypass, err := newBypassVerifier(config)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := compileRules(config.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	syslog, err := newSyslogSink(config, metrics, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	crowdsec, err := newCrowdsecBouncer(config, metrics, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	icap, err := newICAPScanner(config)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := newPolicyClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	exemptions, err := compileExemptions(config.RuleExemptions)
+	if err != nil {
+		return nil, err
+	}
+
+	feeds, err := newThreatFeeds(config, metrics, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	learning, err := newLearner(config)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol, err := newProtocolChecker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	modSecurityUrl := config.ModSecurityUrl
+	if socketPath, ok := unixSocketPath(modSecurityUrl); ok {
+		if len(socketPath) == 0 {
+			return nil, fmt.Errorf("modSecurityUrl unix socket path cannot be empty")
+		}
+		modSecurityUrl = unixSocketBaseUrl
+	}
+
+	a := &Modsecurity{
+		modSecurityUrl: modSecurityUrl,
 		maxBodySize:    config.MaxBodySize,
 		next:           next,
 		name:           name,
-		httpClient:     &http.Client{Timeout: timeout},
-		logger:         log.New(os.Stdout, "", log.LstdFlags),
-	}, nil
+		httpClient:     &http.Client{Timeout: timeout, Transport: transport},
+		logger:         logger,
+		authMode:       config.AuthMode,
+		authSecret:     authSecret,
+		sampler:        sampler,
+		metrics:        metrics,
+		limiter:        limiter,
+		overflowPolicy: config.OverflowPolicy,
+		retryAfter:     intOrDefault(config.RetryAfterSeconds, 1),
+		statsPath:      config.StatsPath,
+		responsePolicy: newResponsePolicy(config),
+		bypass:         bypass,
+		rules:          rules,
+		preCheck:       config.PreCheck,
+		health:         newHealthChecker(config),
+		healthPath:     config.HealthPath,
+		selfTest:       newSelfTest(config),
+		ruleIDsHeader:  ruleIDsHeader(config),
+		scoreHeader:    scoreHeader(config),
+		crowdsec:       crowdsec,
+		icap:           icap,
+		policy:         policy,
+		feeds:          feeds,
+		learning:       learning,
+		learningPath:   config.LearningPath,
+		exemptions:     exemptions,
+		protocol:       protocol,
+		requestLimits:  newRequestLimits(config),
+	}
+
+	switch config.UnhealthyPolicy {
+	case "", unhealthyReject, unhealthyBypass:
+	default:
+		return nil, fmt.Errorf("unsupported unhealthyPolicy %q", config.UnhealthyPolicy)
+	}
+	if a.healthPath != "" && a.health == nil {
+		return nil, fmt.Errorf("healthPath requires healthCheckIntervalMillis")
+	}
+
+	switch config.PreCheck {
+	case "", preCheckLocal, preCheckWaf:
+	default:
+		return nil, fmt.Errorf("unsupported preCheck %q", config.PreCheck)
+	}
+
+	switch config.Mode {
+	case "", modeInline:
+	case modeMirror:
+		a.startMirror(ctx, intOrDefault(config.MirrorWorkers, 4), intOrDefault(config.MirrorQueueSize, 100))
+	case modeParallel:
+		parallel, err := newParallel(config)
+		if err != nil {
+			return nil, err
+		}
+		a.parallel = parallel
+	default:
+		return nil, fmt.Errorf("unsupported mode %q", config.Mode)
+	}
+
+	if syslog != nil {
+		a.sinks = append(a.sinks, syslog)
+		go syslog.run(ctx)
+	}
+
+	if webhook := newWebhookSink(config, metrics, a.logger); webhook != nil {
+		a.sinks = append(a.sinks, webhook)
+		go webhook.run(ctx)
+	}
+
+	if crowdsec != nil {
+		if crowdsec.signals != nil {
+			a.sinks = append(a.sinks, crowdsec)
+		}
+		go crowdsec.run(ctx)
+	}
+
+	if feeds != nil {
+		go feeds.run(ctx)
+	}
+
+	if a.health != nil {
+		a.startHealthCheck(ctx)
+	}
+	if a.selfTest != nil {
+		a.startSelfTest(ctx)
+	}
+
+	return a, nil
 }
 
 func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if a.statsPath != "" && req.URL.Path == a.statsPath {
+		a.serveStats(rw)
+		return
+	}
+	if a.healthPath != "" && req.URL.Path == a.healthPath {
+		a.serveHealth(rw)
+		return
+	}
+	if a.learningPath != "" && req.URL.Path == a.learningPath && a.learning.serves(req) {
+		a.serveLearning(rw, req)
+		return
+	}
+
+	// banned clients do not cost a WAF call, whatever they send
+	if a.crowdsecBanned(rw, req) {
+		return
+	}
+
+	// tags can only come from the rules and the feeds
+	if len(a.rules) > 0 || a.feeds != nil {
+		req.Header.Del(ruleTagHeader)
+	}
+	if a.matchFeeds(rw, req) {
+		return
+	}
+
+	// requests the WAF and the service could read differently
+	if a.protocolRejected(rw, req) {
+		return
+	}
+	if a.limitExceeded(rw, req) {
+		return
+	}
 
 	// Websocket not supported
 	if isWebsocket(req) {
@@ -73,6 +489,29 @@ func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	bypassMode := a.checkBypass(req)
+	if bypassMode == bypassModeSkip {
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+
+	if !a.sampler.sampled(req) {
+		a.metrics.inc("requests_unsampled")
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+	a.metrics.inc("requests_inspected")
+
+	// reject what can be rejected before the body is read, the client waiting
+	// for 100-continue does not even upload it
+	rulesPhase := rulesPhaseAll
+	if a.preCheck != "" && hasBody(req) {
+		if a.headerPhase(rw, req, bypassMode) {
+			return
+		}
+		rulesPhase = rulesPhaseBody
+	}
+
 	// we need to buffer the body if we want to read it here and send it
 	// in the request.
 	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, a.maxBodySize))
@@ -90,40 +529,125 @@ func (a *Modsecurity) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// you can reassign the body if you need to parse it as multipart
 	req.Body = ioutil.NopCloser(bytes.NewReader(body))
 
-	// create a new url from the raw RequestURI sent by the client
-	url := fmt.Sprintf("%s%s", a.modSecurityUrl, req.RequestURI)
+	if a.applyRules(rw, req, body, rulesPhase) {
+		return
+	}
 
-	proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body))
+	if a.icapInfected(rw, req, body) {
+		return
+	}
+
+	if a.mirror != nil {
+		a.mirrorRequest(req, body)
+		a.next.ServeHTTP(rw, req)
+		return
+	}
 
+	if a.selfTestFailed(rw) {
+		return
+	}
+
+	if answered, bypass := a.unhealthy(rw, req); answered || bypass {
+		if bypass {
+			a.next.ServeHTTP(rw, req)
+		}
+		return
+	}
+
+	// the client context cancels the WAF call when the client goes away, and
+	// its deadline applies when shorter than timeoutMillis
+	proxyReq, err := a.newWafRequest(req.Context(), req, body)
 	if err != nil {
 		a.logger.Printf("fail to prepare forwarded request: %s", err.Error())
 		http.Error(rw, "", http.StatusBadGateway)
 		return
 	}
 
-	// We may want to filter some headers, otherwise we could just use a shallow copy
-	// proxyReq.Header = req.Header
-	proxyReq.Header = make(http.Header)
-	for h, val := range req.Header {
-		proxyReq.Header[h] = val
+	if !a.limiter.acquire(req.Context()) {
+		if req.Context().Err() != nil {
+			a.clientGone(rw, req)
+			return
+		}
+		if a.shed(rw, req) {
+			return
+		}
+		a.next.ServeHTTP(rw, req)
+		return
+	}
+	if a.parallel != nil && a.parallel.methods[req.Method] {
+		a.serveParallel(rw, req, proxyReq, body, bypassMode)
+		return
 	}
 
+	a.signRequest(proxyReq, body)
 	resp, err := a.httpClient.Do(proxyReq)
+	a.limiter.release()
 	if err != nil {
-		a.logger.Printf("fail to send HTTP request to modsec: %s", err.Error())
-		http.Error(rw, "", http.StatusBadGateway)
+		a.wafError(rw, req, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		forwardResponse(resp, rw)
+	a.learn(req, body, resp)
+	if a.blocked(rw, req, resp, bypassMode, true) {
 		return
 	}
 
 	a.next.ServeHTTP(rw, req)
 }
 
+// wafError answers a request whose WAF call failed.
+func (a *Modsecurity) wafError(rw http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() != nil {
+		a.clientGone(rw, req)
+		return
+	}
+	a.logger.Printf("fail to send HTTP request to modsec: %s", err.Error())
+	a.metrics.inc("requests_waf_error")
+	a.emit(a.newEvent(req, eventActionError, err.Error(), http.StatusBadGateway))
+	http.Error(rw, "", http.StatusBadGateway)
+}
+
+// blocked answers the request and returns true when the WAF, or the policy
+// endpoint, blocked it. In detect-only bypass the block is only logged.
+func (a *Modsecurity) blocked(rw http.ResponseWriter, req *http.Request, resp *http.Response, bypassMode string, final bool) bool {
+	return a.enforce(rw, req, resp, a.decide(req, resp, bypassMode, final))
+}
+
+// newWafRequest prepares the request sent to the modsecurity container, a
+// copy of req with the buffered body.
+func (a *Modsecurity) newWafRequest(ctx context.Context, req *http.Request, body []byte) (*http.Request, error) {
+	// create a new url from the raw RequestURI sent by the client
+	url := fmt.Sprintf("%s%s", a.modSecurityUrl, req.RequestURI)
+
+	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// We may want to filter some headers, otherwise we could just use a shallow copy
+	proxyReq.Header = make(http.Header)
+	for h, val := range req.Header {
+		proxyReq.Header[h] = append([]string(nil), val...)
+	}
+	return proxyReq, nil
+}
+
+// clientGone answers a request whose context was cancelled by the client or
+// reached its deadline before the WAF answered.
+func (a *Modsecurity) clientGone(rw http.ResponseWriter, req *http.Request) {
+	if req.Context().Err() == context.DeadlineExceeded {
+		a.logger.Printf("deadline exceeded before modsec answered: %s %s", req.Method, req.URL.Path)
+		a.metrics.inc("requests_deadline_exceeded")
+		http.Error(rw, "", http.StatusGatewayTimeout)
+		return
+	}
+	a.logger.Printf("client cancelled request before modsec answered: %s %s", req.Method, req.URL.Path)
+	a.metrics.inc("requests_client_cancelled")
+	// nobody is listening anymore, 499 is the de facto status for this case
+	rw.WriteHeader(statusClientClosedRequest)
+}
+
 func isWebsocket(req *http.Request) bool {
 	for _, header := range req.Header["Upgrade"] {
 		if header == "websocket" {
@@ -132,16 +656,3 @@ func isWebsocket(req *http.Request) bool {
 	}
 	return false
 }
-
-func forwardResponse(resp *http.Response, rw http.ResponseWriter) {
-	// copy headers
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			rw.Header().Set(k, v)
-		}
-	}
-	// copy status
-	rw.WriteHeader(resp.StatusCode)
-	// copy body
-	io.Copy(rw, resp.Body)
-}
@@ -3,11 +3,13 @@ package traefik_modsecurity_plugin
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -150,3 +152,73 @@ func generateLargeBody(size int) io.ReadCloser {
 	var str = make([]byte, size)
 	return io.NopCloser(bytes.NewReader(str))
 }
+
+func TestModsecurity_ServeHTTP_ClientContext(t *testing.T) {
+	tests := []struct {
+		name         string
+		context      func() (context.Context, context.CancelFunc)
+		expectStatus int
+		expectMetric string
+	}{
+		{
+			name: "Cancels WAF call when client goes away",
+			context: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(20*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			expectStatus: statusClientClosedRequest,
+			expectMetric: "requests_client_cancelled",
+		},
+		{
+			name: "Honours upstream deadline shorter than timeout",
+			context: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 20*time.Millisecond)
+			},
+			expectStatus: http.StatusGatewayTimeout,
+			expectMetric: "requests_deadline_exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCancelled := make(chan struct{})
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					close(wafCancelled)
+				case <-time.After(5 * time.Second):
+				}
+			}))
+			defer modsecurityMockServer.Close()
+
+			middleware := &Modsecurity{
+				next:           http.NotFoundHandler(),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     &http.Client{Timeout: 5 * time.Second},
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+			}
+
+			ctx, cancel := tt.context()
+			defer cancel()
+			req := httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx)
+
+			start := time.Now()
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, int64(1), middleware.metrics.get(tt.expectMetric))
+			assert.Equal(t, int64(0), middleware.metrics.get("requests_waf_error"))
+
+			select {
+			case <-wafCancelled:
+			case <-time.After(time.Second):
+				t.Error("WAF call was not cancelled")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const modeParallel = "parallel"
+
+const defaultMaxBufferedResponseSize = 1024 * 1024
+
+// errResponseDiscarded is returned to the service when the WAF blocked the
+// request while its response was being held back.
+var errResponseDiscarded = errors.New("response discarded, request blocked by modsec")
+
+// parallel holds the settings of the parallel dispatch mode.
+type parallel struct {
+	methods     map[string]bool
+	maxBuffered int64
+}
+
+// safeMethods can be dispatched in parallel: the service handles a request
+// before the WAF verdict, so it must not have side effects.
+var safeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+func newParallel(config *Config) (*parallel, error) {
+	methods := config.ParallelMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	p := &parallel{
+		methods:     make(map[string]bool),
+		maxBuffered: config.MaxBufferedResponseSize,
+	}
+	if p.maxBuffered <= 0 {
+		p.maxBuffered = defaultMaxBufferedResponseSize
+	}
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		if !safeMethods[m] {
+			return nil, fmt.Errorf("unsupported parallelMethods %q", m)
+		}
+		p.methods[m] = true
+	}
+	return p, nil
+}
+
+type wafResult struct {
+	resp *http.Response
+	err  error
+}
+
+// serveParallel calls the WAF and the service at the same time. The service
+// response is held back until the WAF allows the request, and discarded if
+// the WAF blocks it. The limiter slot must already be acquired.
+func (a *Modsecurity) serveParallel(rw http.ResponseWriter, req *http.Request, proxyReq *http.Request, body []byte, bypassMode string) {
+	results := make(chan wafResult, 1)
+	go func() {
+		a.signRequest(proxyReq, body)
+		resp, err := a.httpClient.Do(proxyReq)
+		a.limiter.release()
+		results <- wafResult{resp: resp, err: err}
+	}()
+
+	var result *wafResult
+	verdict := func() *wafResult {
+		if result == nil {
+			r := <-results
+			result = &r
+		}
+		return result
+	}
+
+	// the decision is taken once, the policy endpoint may be called for it
+	var d *decision
+	decide := func(r *wafResult) decision {
+		if d == nil {
+			decided := a.decide(req, r.resp, bypassMode, true)
+			d = &decided
+		}
+		return *d
+	}
+
+	hw := &holdBackWriter{
+		rw:     rw,
+		header: make(http.Header),
+		max:    a.parallel.maxBuffered,
+		allowed: func() bool {
+			r := verdict()
+			return r.err == nil && !decide(r).block
+		},
+	}
+	a.next.ServeHTTP(hw, req)
+
+	r := verdict()
+	if r.err != nil {
+		a.wafError(rw, req, r.err)
+		return
+	}
+	defer r.resp.Body.Close()
+
+	a.learn(req, body, r.resp)
+	if a.enforce(rw, req, r.resp, decide(r)) {
+		a.metrics.inc("parallel_discarded")
+		return
+	}
+	hw.release()
+}
+
+// holdBackWriter buffers the service response until the WAF verdict. When
+// the response outgrows the buffer, it waits for the verdict and either
+// streams the response or discards it.
+type holdBackWriter struct {
+	rw      http.ResponseWriter
+	header  http.Header
+	status  int
+	buf     bytes.Buffer
+	max     int64
+	allowed func() bool
+
+	released  bool
+	discarded bool
+}
+
+func (w *holdBackWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *holdBackWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.released {
+		w.rw.WriteHeader(status)
+	}
+}
+
+func (w *holdBackWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discarded {
+		return 0, errResponseDiscarded
+	}
+	if w.released {
+		return w.rw.Write(p)
+	}
+
+	if int64(w.buf.Len()+len(p)) <= w.max {
+		return w.buf.Write(p)
+	}
+
+	// the buffer is full, the verdict decides what happens to the response
+	if !w.allowed() {
+		w.discarded = true
+		w.buf.Reset()
+		return 0, errResponseDiscarded
+	}
+	w.release()
+	return w.rw.Write(p)
+}
+
+// release sends the held back response to the client.
+func (w *holdBackWriter) release() {
+	if w.released || w.discarded {
+		return
+	}
+	w.released = true
+
+	for k, vv := range w.header {
+		w.rw.Header()[k] = vv
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.rw.WriteHeader(w.status)
+	w.rw.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
@@ -0,0 +1,140 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ServeHTTP_Parallel(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		wafStatus     int
+		serviceBody   string
+		maxBuffered   int64
+		expectStatus  int
+		expectBody    string
+		expectService bool
+		expectWrite   error
+	}{
+		{
+			name:          "Releases service response when WAF allows",
+			method:        http.MethodGet,
+			wafStatus:     http.StatusOK,
+			serviceBody:   "Response from service",
+			expectStatus:  http.StatusAccepted,
+			expectBody:    "Response from service",
+			expectService: true,
+		},
+		{
+			name:          "Discards service response when WAF blocks",
+			method:        http.MethodGet,
+			wafStatus:     http.StatusForbidden,
+			serviceBody:   "Response from service",
+			expectStatus:  http.StatusForbidden,
+			expectBody:    "Response from waf",
+			expectService: true,
+		},
+		{
+			name:          "Streams response larger than the buffer once WAF allows",
+			method:        http.MethodGet,
+			wafStatus:     http.StatusOK,
+			serviceBody:   strings.Repeat("x", 100),
+			maxBuffered:   10,
+			expectStatus:  http.StatusAccepted,
+			expectBody:    strings.Repeat("x", 100),
+			expectService: true,
+		},
+		{
+			name:          "Discards response larger than the buffer when WAF blocks",
+			method:        http.MethodGet,
+			wafStatus:     http.StatusForbidden,
+			serviceBody:   strings.Repeat("x", 100),
+			maxBuffered:   10,
+			expectStatus:  http.StatusForbidden,
+			expectBody:    "Response from waf",
+			expectService: true,
+			expectWrite:   errResponseDiscarded,
+		},
+		{
+			name:          "Waits for the verdict for other methods",
+			method:        http.MethodPost,
+			wafStatus:     http.StatusForbidden,
+			serviceBody:   "Response from service",
+			expectStatus:  http.StatusForbidden,
+			expectBody:    "Response from waf",
+			expectService: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serviceCalled int32
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// answer once the service is done if it is called in parallel
+				deadline := time.Now().Add(100 * time.Millisecond)
+				for atomic.LoadInt32(&serviceCalled) == 0 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				w.WriteHeader(tt.wafStatus)
+				w.Write([]byte("Response from waf"))
+			}))
+			defer modsecurityMockServer.Close()
+			parallel, err := newParallel(&Config{MaxBufferedResponseSize: tt.maxBuffered})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var writeErr error
+			middleware := &Modsecurity{
+				next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					atomic.StoreInt32(&serviceCalled, 1)
+					w.Header().Set("X-Service", "1")
+					w.WriteHeader(http.StatusAccepted)
+					_, writeErr = w.Write([]byte(tt.serviceBody))
+				}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				parallel:       parallel,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(tt.method, "/test", nil))
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectBody, rw.Body.String())
+			assert.Equal(t, tt.expectService, atomic.LoadInt32(&serviceCalled) == 1)
+			assert.Equal(t, tt.expectWrite, writeErr)
+			if tt.expectStatus == http.StatusForbidden {
+				assert.Empty(t, rw.Header().Get("X-Service"))
+			} else {
+				assert.Equal(t, "1", rw.Header().Get("X-Service"))
+			}
+		})
+	}
+}
+
+func TestNewParallel_Methods(t *testing.T) {
+	p, err := newParallel(&Config{ParallelMethods: []string{"get", "trace"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, p.methods[http.MethodGet])
+	assert.True(t, p.methods[http.MethodTrace])
+
+	for _, method := range []string{"post", "PUT", "PATCH", "DELETE", "CONNECT", "PROPFIND"} {
+		_, err := newParallel(&Config{ParallelMethods: []string{method}})
+		assert.Error(t, err, method)
+	}
+}
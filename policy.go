@@ -0,0 +1,236 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	policyFailureWaf   = "waf"
+	policyFailureAllow = "allow"
+	policyFailureDeny  = "deny"
+)
+
+// policyInput is the document POSTed to the policy endpoint, wrapped in
+// "input" as expected by the OPA data API.
+type policyInput struct {
+	Request policyRequest `json:"request"`
+	Waf     policyWaf     `json:"waf"`
+}
+
+type policyRequest struct {
+	Method   string            `json:"method"`
+	Host     string            `json:"host"`
+	Path     string            `json:"path"`
+	Query    string            `json:"query"`
+	ClientIP string            `json:"clientIp"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+type policyWaf struct {
+	Status  int      `json:"status"`
+	Blocked bool     `json:"blocked"`
+	Score   int      `json:"score"`
+	RuleIDs []string `json:"ruleIds"`
+}
+
+// policyResult is the decision of the policy endpoint. The endpoint may
+// also answer a bare boolean.
+type policyResult struct {
+	Allow   bool   `json:"allow"`
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type policyCacheEntry struct {
+	result  policyResult
+	expires time.Time
+}
+
+// policyClient asks an external policy endpoint, such as OPA, for the final
+// decision on a request once the WAF has answered.
+type policyClient struct {
+	url           string
+	client        *http.Client
+	headers       []string
+	failurePolicy string
+
+	cacheTTL  time.Duration
+	cacheSize int
+	mu        sync.Mutex
+	cache     map[string]policyCacheEntry
+}
+
+func newPolicyClient(config *Config) (*policyClient, error) {
+	if config.PolicyUrl == "" {
+		return nil, nil
+	}
+
+	p := &policyClient{
+		url:           config.PolicyUrl,
+		client:        &http.Client{Timeout: millisOrDefault(config.PolicyTimeoutMillis, time.Second)},
+		headers:       config.PolicyHeaders,
+		failurePolicy: config.PolicyFailurePolicy,
+		cacheTTL:      time.Duration(config.PolicyCacheTTLMillis) * time.Millisecond,
+		cacheSize:     intOrDefault(config.PolicyCacheSize, 10000),
+		cache:         make(map[string]policyCacheEntry),
+	}
+	if len(p.headers) == 0 {
+		p.headers = []string{"Authorization"}
+	}
+
+	switch p.failurePolicy {
+	case "":
+		p.failurePolicy = policyFailureWaf
+	case policyFailureWaf, policyFailureAllow, policyFailureDeny:
+	default:
+		return nil, fmt.Errorf("unsupported policyFailurePolicy %q", config.PolicyFailurePolicy)
+	}
+	return p, nil
+}
+
+// policyDecision returns the decision of the policy endpoint, or nil when
+// the WAF verdict stands because the endpoint failed.
+func (a *Modsecurity) policyDecision(req *http.Request, verdict wafVerdict) *policyResult {
+	if a.policy == nil {
+		return nil
+	}
+
+	input := policyInput{
+		Request: policyRequest{
+			Method:   req.Method,
+			Host:     req.Host,
+			Path:     req.URL.Path,
+			Query:    req.URL.RawQuery,
+			ClientIP: clientIP(req),
+		},
+		Waf: policyWaf{
+			Status:  verdict.status,
+			Blocked: verdict.blocked(),
+			Score:   verdict.score,
+			RuleIDs: verdict.ruleIDs,
+		},
+	}
+	for _, h := range a.policy.headers {
+		if v := req.Header.Get(h); v != "" {
+			if input.Request.Headers == nil {
+				input.Request.Headers = make(map[string]string)
+			}
+			input.Request.Headers[strings.ToLower(h)] = v
+		}
+	}
+
+	result, err := a.policy.decide(req.Context(), input)
+	if err == nil {
+		a.metrics.inc("policy_decisions")
+		return &result
+	}
+
+	a.metrics.inc("policy_error")
+	a.logger.Printf("fail to get policy decision for %s %s: %s", req.Method, req.URL.Path, err.Error())
+	switch a.policy.failurePolicy {
+	case policyFailureAllow:
+		return &policyResult{Allow: true}
+	case policyFailureDeny:
+		return &policyResult{Status: http.StatusBadGateway}
+	default:
+		return nil
+	}
+}
+
+func (p *policyClient) decide(ctx context.Context, input policyInput) (policyResult, error) {
+	body, err := json.Marshal(map[string]policyInput{"input": input})
+	if err != nil {
+		return policyResult{}, err
+	}
+
+	var key string
+	if p.cacheTTL > 0 {
+		sum := sha256.Sum256(body)
+		key = string(sum[:])
+		if result, ok := p.cached(key); ok {
+			return result, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return policyResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return policyResult{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return policyResult{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var decoded struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return policyResult{}, fmt.Errorf("invalid policy response: %w", err)
+	}
+	// OPA leaves out the result when the policy is not defined
+	if len(decoded.Result) == 0 {
+		return policyResult{}, fmt.Errorf("policy response without result")
+	}
+
+	var result policyResult
+	if err := json.Unmarshal(decoded.Result, &result.Allow); err != nil {
+		if err := json.Unmarshal(decoded.Result, &result); err != nil {
+			return policyResult{}, fmt.Errorf("invalid policy result: %w", err)
+		}
+	}
+	// a block must answer an error, and WriteHeader panics on odd codes
+	if result.Status != 0 && (result.Status < 400 || result.Status > 599) {
+		return policyResult{}, fmt.Errorf("invalid policy result status %d", result.Status)
+	}
+
+	if p.cacheTTL > 0 {
+		p.store(key, result)
+	}
+	return result, nil
+}
+
+func (p *policyClient) cached(key string) (policyResult, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return policyResult{}, false
+	}
+	return entry.result, true
+}
+
+func (p *policyClient) store(key string, result policyResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if len(p.cache) >= p.cacheSize {
+		for k, entry := range p.cache {
+			if now.After(entry.expires) {
+				delete(p.cache, k)
+			}
+		}
+		// still full of live entries: start over rather than tracking usage
+		if len(p.cache) >= p.cacheSize {
+			p.cache = make(map[string]policyCacheEntry)
+		}
+	}
+	p.cache[key] = policyCacheEntry{result: result, expires: now.Add(p.cacheTTL)}
+}
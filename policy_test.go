@@ -0,0 +1,250 @@
+package traefik_modsecurity_plugin
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ServeHTTP_Policy(t *testing.T) {
+	tests := []struct {
+		name           string
+		wafStatus      int
+		policyResult   string
+		policyStatus   int
+		failurePolicy  string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Policy denies a request allowed by the WAF",
+			wafStatus:      http.StatusOK,
+			policyResult:   `{"allow": false, "status": 402, "message": "upgrade your plan"}`,
+			expectedStatus: http.StatusPaymentRequired,
+			expectedBody:   "upgrade your plan\n",
+		},
+		{
+			name:           "Policy denies without status",
+			wafStatus:      http.StatusOK,
+			policyResult:   `{"allow": false}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Policy allows a request blocked by the WAF",
+			wafStatus:      http.StatusForbidden,
+			policyResult:   `{"allow": true}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "service",
+		},
+		{
+			name:           "Policy confirms the WAF block",
+			wafStatus:      http.StatusForbidden,
+			policyResult:   `false`,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "modsec",
+		},
+		{
+			name:           "Undefined policy keeps the WAF verdict",
+			wafStatus:      http.StatusForbidden,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "modsec",
+		},
+		{
+			name:           "Failing policy allows",
+			wafStatus:      http.StatusForbidden,
+			policyStatus:   http.StatusInternalServerError,
+			failurePolicy:  policyFailureAllow,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "service",
+		},
+		{
+			name:           "Redirect status is an invalid result",
+			wafStatus:      http.StatusOK,
+			policyResult:   `{"allow": false, "status": 302}`,
+			failurePolicy:  policyFailureDeny,
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "Out of range status keeps the WAF verdict",
+			wafStatus:      http.StatusForbidden,
+			policyResult:   `{"allow": false, "status": 1200}`,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "modsec",
+		},
+		{
+			name:           "Failing policy denies",
+			wafStatus:      http.StatusOK,
+			policyStatus:   http.StatusInternalServerError,
+			failurePolicy:  policyFailureDeny,
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Waf-Rule-Ids", "942100")
+				w.WriteHeader(tt.wafStatus)
+				io.WriteString(w, "modsec")
+			}))
+			defer modsecurityMockServer.Close()
+
+			var input map[string]policyInput
+			policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&input)
+				if tt.policyStatus != 0 {
+					w.WriteHeader(tt.policyStatus)
+					return
+				}
+				if tt.policyResult == "" {
+					io.WriteString(w, `{}`)
+					return
+				}
+				io.WriteString(w, `{"result": `+tt.policyResult+`}`)
+			}))
+			defer policyServer.Close()
+
+			policy, err := newPolicyClient(&Config{PolicyUrl: policyServer.URL, PolicyFailurePolicy: tt.failurePolicy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			middleware := &Modsecurity{
+				next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "service")
+				}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				ruleIDsHeader:  defaultRuleIDsHeader,
+				scoreHeader:    defaultScoreHeader,
+				policy:         policy,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/search?q=1", nil)
+			req.Header.Set("Authorization", "Bearer jwt")
+			req.Header.Set("Cookie", "session=secret")
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, rw.Body.String())
+			}
+			assert.Equal(t, policyRequest{
+				Method:   http.MethodGet,
+				Host:     "example.com",
+				Path:     "/api/search",
+				Query:    "q=1",
+				ClientIP: "192.0.2.1",
+				Headers:  map[string]string{"authorization": "Bearer jwt"},
+			}, input["input"].Request)
+			assert.Equal(t, policyWaf{
+				Status:  tt.wafStatus,
+				Blocked: tt.wafStatus >= 400,
+				RuleIDs: []string{"942100"},
+			}, input["input"].Waf)
+		})
+	}
+}
+
+func TestModsecurity_ServeHTTP_PolicyPreCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedWaf    []bool
+	}{
+		{
+			name:           "Request allowed on headers is decided after the body",
+			path:           "/upload",
+			expectedStatus: http.StatusForbidden,
+			expectedWaf:    []bool{false},
+		},
+		{
+			name:           "Request blocked on headers is decided before the body",
+			path:           "/upload?file=../etc/passwd",
+			expectedStatus: http.StatusForbidden,
+			expectedWaf:    []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("file") != "" {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			}))
+			defer modsecurityMockServer.Close()
+
+			var wafBlocked []bool
+			policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var input map[string]policyInput
+				json.NewDecoder(r.Body).Decode(&input)
+				wafBlocked = append(wafBlocked, input["input"].Waf.Blocked)
+				io.WriteString(w, `{"result": false}`)
+			}))
+			defer policyServer.Close()
+
+			policy, err := newPolicyClient(&Config{PolicyUrl: policyServer.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				policy:         policy,
+				preCheck:       preCheckWaf,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader("upload")))
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			assert.Equal(t, tt.expectedWaf, wafBlocked)
+		})
+	}
+}
+
+func TestPolicyClient_Cache(t *testing.T) {
+	var calls int32
+	policyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var input map[string]policyInput
+		json.NewDecoder(r.Body).Decode(&input)
+		json.NewEncoder(w).Encode(map[string]policyResult{
+			"result": {Allow: input["input"].Request.Path == "/public"},
+		})
+	}))
+	defer policyServer.Close()
+
+	policy, err := newPolicyClient(&Config{PolicyUrl: policyServer.URL, PolicyCacheTTLMillis: 60000, PolicyCacheSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := &Modsecurity{logger: log.New(io.Discard, "", log.LstdFlags), policy: policy}
+
+	for _, path := range []string{"/public", "/public", "/private", "/private", "/public"} {
+		result := middleware.policyDecision(httptest.NewRequest(http.MethodGet, path, nil), wafVerdict{status: http.StatusOK})
+		assert.Equal(t, path == "/public", result.Allow, path)
+	}
+	// the cache holds a single entry, so the path change evicts it
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestNewPolicyClient_Errors(t *testing.T) {
+	_, err := newPolicyClient(&Config{PolicyUrl: "http://opa:8181/v1/data/waf", PolicyFailurePolicy: "retry"})
+	assert.Error(t, err)
+}
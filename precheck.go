@@ -0,0 +1,58 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+)
+
+const (
+	preCheckLocal = "local"
+	preCheckWaf   = "waf"
+)
+
+func hasBody(req *http.Request) bool {
+	return req.ContentLength != 0 || len(req.TransferEncoding) > 0
+}
+
+// headerPhase inspects a request before its body is read. It returns true
+// when the request has been answered.
+func (a *Modsecurity) headerPhase(rw http.ResponseWriter, req *http.Request, bypassMode string) bool {
+	if a.applyRules(rw, req, nil, rulesPhaseHeaders) {
+		a.metrics.inc("precheck_answered")
+		return true
+	}
+	if a.preCheck != preCheckWaf {
+		return false
+	}
+
+	// a busy WAF is dealt with by the full inspection
+	if !a.limiter.acquire(req.Context()) {
+		return false
+	}
+
+	proxyReq, err := a.newWafRequest(req.Context(), req, nil)
+	if err != nil {
+		a.limiter.release()
+		a.logger.Printf("fail to prepare header phase request: %s", err.Error())
+		http.Error(rw, "", http.StatusBadGateway)
+		return true
+	}
+	for _, h := range []string{"Content-Length", "Transfer-Encoding", "Expect"} {
+		proxyReq.Header.Del(h)
+	}
+
+	a.signRequest(proxyReq, nil)
+	resp, err := a.httpClient.Do(proxyReq)
+	a.limiter.release()
+	if err != nil {
+		a.wafError(rw, req, err)
+		return true
+	}
+	defer resp.Body.Close()
+
+	if a.blocked(rw, req, resp, bypassMode, false) {
+		a.logger.Printf("modsec blocked %s %s before reading the body", req.Method, req.URL.Path)
+		a.metrics.inc("precheck_blocked")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uploadBody records whether the client started sending the body.
+type uploadBody struct {
+	io.Reader
+	read int32
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.Reader.Read(p)
+}
+
+func TestModsecurity_ServeHTTP_PreCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		preCheck     string
+		rules        []Rule
+		path         string
+		expectStatus int
+		expectUpload bool
+		expectWaf    []int64
+	}{
+		{
+			name:         "Rejects upload blocked by WAF on headers",
+			preCheck:     preCheckWaf,
+			path:         "/upload?file=../etc/passwd",
+			expectStatus: http.StatusForbidden,
+			expectUpload: false,
+			expectWaf:    []int64{0},
+		},
+		{
+			name:         "Reads and inspects upload allowed on headers",
+			preCheck:     preCheckWaf,
+			path:         "/upload",
+			expectStatus: http.StatusOK,
+			expectUpload: true,
+			expectWaf:    []int64{0, 10},
+		},
+		{
+			name:         "Rejects upload blocked by a local rule",
+			preCheck:     preCheckLocal,
+			rules:        []Rule{{ID: "no-upload", Path: "^/upload$", Action: ruleActionBlock}},
+			path:         "/upload",
+			expectStatus: http.StatusForbidden,
+			expectUpload: false,
+		},
+		{
+			name:         "Evaluates body rules once the body is read",
+			preCheck:     preCheckLocal,
+			rules:        []Rule{{ID: "no-x", BodyContains: "xxxx", Action: ruleActionBlock}},
+			path:         "/upload",
+			expectStatus: http.StatusForbidden,
+			expectUpload: true,
+			expectWaf:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wafBodies []int64
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				wafBodies = append(wafBodies, int64(len(body)))
+				if r.URL.Query().Get("file") != "" {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			}))
+			defer modsecurityMockServer.Close()
+
+			compiled, err := compileRules(tt.rules)
+			assert.NoError(t, err)
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				rules:          compiled,
+				preCheck:       tt.preCheck,
+			}
+			traefik := httptest.NewServer(middleware)
+			defer traefik.Close()
+
+			body := &uploadBody{Reader: strings.NewReader(strings.Repeat("x", 10))}
+			req, err := http.NewRequest(http.MethodPost, traefik.URL+tt.path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.ContentLength = 10
+			req.Header.Set("Expect", "100-continue")
+
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectStatus, resp.StatusCode)
+			assert.Equal(t, tt.expectUpload, atomic.LoadInt32(&body.read) == 1)
+			assert.Equal(t, tt.expectWaf, wafBodies)
+		})
+	}
+}
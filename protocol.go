@@ -0,0 +1,178 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Protocol checks, each name is also the reason logged when it rejects a
+// request.
+const (
+	checkConflictingLength      = "conflicting-length"
+	checkDuplicateContentLength = "duplicate-content-length"
+	checkInvalidHeaderName      = "invalid-header-name"
+	checkInvalidHeaderValue     = "invalid-header-value"
+	checkURIControlCharacter    = "uri-control-character"
+	checkMethodNotAllowed       = "method-not-allowed"
+
+	protocolChecksAll = "all"
+)
+
+var protocolChecks = []string{
+	checkConflictingLength,
+	checkDuplicateContentLength,
+	checkInvalidHeaderName,
+	checkInvalidHeaderValue,
+	checkURIControlCharacter,
+	checkMethodNotAllowed,
+}
+
+var defaultAllowedMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// protocolChecker rejects the malformed requests that the WAF and the
+// service could parse differently. Behind the net/http server, the framing
+// and header checks are defence in depth: the server already drops
+// Content-Length next to Transfer-Encoding, merges identical Content-Length
+// values and answers 400 to the other cases before the middleware runs. They
+// fire on requests built or altered by other handlers.
+type protocolChecker struct {
+	checks  map[string]bool
+	methods map[string]bool
+	allow   string
+}
+
+func newProtocolChecker(config *Config) (*protocolChecker, error) {
+	if len(config.ProtocolChecks) == 0 {
+		return nil, nil
+	}
+
+	p := &protocolChecker{checks: make(map[string]bool), methods: make(map[string]bool)}
+	for _, c := range config.ProtocolChecks {
+		if c == protocolChecksAll {
+			for _, name := range protocolChecks {
+				p.checks[name] = true
+			}
+			continue
+		}
+		known := false
+		for _, name := range protocolChecks {
+			known = known || name == c
+		}
+		if !known {
+			return nil, fmt.Errorf("unsupported protocolChecks %q", c)
+		}
+		p.checks[c] = true
+	}
+
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultAllowedMethods
+	}
+	var allow []string
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		if !p.methods[m] {
+			allow = append(allow, m)
+		}
+		p.methods[m] = true
+	}
+	p.allow = strings.Join(allow, ", ")
+	return p, nil
+}
+
+// check returns the reason of the first failed check, or "".
+func (p *protocolChecker) check(req *http.Request) string {
+	if p.checks[checkMethodNotAllowed] && !p.methods[req.Method] {
+		return checkMethodNotAllowed
+	}
+	if p.checks[checkURIControlCharacter] && (hasControlCharacter(req.RequestURI) || hasControlCharacter(req.URL.Path)) {
+		return checkURIControlCharacter
+	}
+
+	contentLength := req.Header.Values("Content-Length")
+	if p.checks[checkDuplicateContentLength] &&
+		(len(contentLength) > 1 || (len(contentLength) == 1 && strings.Contains(contentLength[0], ","))) {
+		return checkDuplicateContentLength
+	}
+	// net/http moves Transfer-Encoding out of the headers
+	chunked := len(req.TransferEncoding) > 0 || req.Header.Get("Transfer-Encoding") != ""
+	if p.checks[checkConflictingLength] && chunked && len(contentLength) > 0 {
+		return checkConflictingLength
+	}
+
+	for name, values := range req.Header {
+		if p.checks[checkInvalidHeaderName] && !isToken(name) {
+			return checkInvalidHeaderName
+		}
+		if p.checks[checkInvalidHeaderValue] {
+			for _, v := range values {
+				if !isHeaderValue(v) {
+					return checkInvalidHeaderValue
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// protocolRejected answers the requests failing a protocol check.
+func (a *Modsecurity) protocolRejected(rw http.ResponseWriter, req *http.Request) bool {
+	if a.protocol == nil {
+		return false
+	}
+	reason := a.protocol.check(req)
+	if reason == "" {
+		return false
+	}
+
+	status := http.StatusBadRequest
+	if reason == checkMethodNotAllowed {
+		status = http.StatusMethodNotAllowed
+		rw.Header().Set("Allow", a.protocol.allow)
+	}
+	a.metrics.inc("protocol_rejected_" + reason)
+	a.logger.Printf("protocol check %s rejected %q %q from %s", reason, req.Method, req.RequestURI, req.RemoteAddr)
+	a.emit(a.newEvent(req, eventActionBlock, "protocol "+reason, status))
+	http.Error(rw, "", status)
+	return true
+}
+
+func hasControlCharacter(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// isToken reports whether name is a valid header name (RFC 9110 token).
+func isToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isHeaderValue reports whether v holds no control character but tabs.
+func isHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if (v[i] < 0x20 && v[i] != '\t') || v[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
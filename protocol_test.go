@@ -0,0 +1,185 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendRaw writes a raw HTTP/1.1 request to server and reads the response.
+func sendRaw(t *testing.T, server *httptest.Server, raw string) *http.Response {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestModsecurity_ServeHTTP_ProtocolChecks(t *testing.T) {
+	var wafCalls int64
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&wafCalls, 1)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer modsecurityMockServer.Close()
+
+	tests := []struct {
+		name           string
+		raw            string
+		expectedStatus int
+		expectedReason string
+		expectedWaf    bool
+	}{
+		{
+			name:           "Valid request",
+			raw:            "POST /login?next=%2Fhome HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nUser-Agent: Mozilla/5.0\t(X11)\r\n\r\nuser",
+			expectedStatus: http.StatusOK,
+			expectedWaf:    true,
+		},
+		{
+			// the server drops Content-Length, the WAF and the service read the chunks
+			name:           "Content-Length and Transfer-Encoding",
+			raw:            "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nuser\r\n0\r\n\r\n",
+			expectedStatus: http.StatusOK,
+			expectedWaf:    true,
+		},
+		{
+			name:           "Identical Content-Length values",
+			raw:            "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nContent-Length: 4\r\n\r\nuser",
+			expectedStatus: http.StatusOK,
+			expectedWaf:    true,
+		},
+		{
+			name:           "Differing Content-Length values",
+			raw:            "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nContent-Length: 12\r\n\r\nuser",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid header name",
+			raw:            "GET / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding : chunked\r\n\r\n",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid header value",
+			raw:            "GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-Host: example.com\x00admin\r\n\r\n",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Encoded control character in the path",
+			raw:            "GET /files/report.pdf%00.txt HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: checkURIControlCharacter,
+		},
+		{
+			name:           "Non standard method",
+			raw:            "PROPFIND / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedReason: checkMethodNotAllowed,
+		},
+	}
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.ProtocolChecks = []string{protocolChecksAll}
+	config.AllowedMethods = []string{"get", "post", "head"}
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := handler.(*Modsecurity)
+	middleware.logger = log.New(io.Discard, "", log.LstdFlags)
+	server := httptest.NewServer(middleware)
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&wafCalls, 0)
+			resp := sendRaw(t, server, tt.raw)
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			assert.Equal(t, tt.expectedWaf, atomic.LoadInt64(&wafCalls) == 1)
+			if tt.expectedReason != "" {
+				assert.Equal(t, int64(1), middleware.metrics.get("protocol_rejected_"+tt.expectedReason))
+			}
+			if tt.expectedReason == checkMethodNotAllowed {
+				assert.Equal(t, "GET, POST, HEAD", resp.Header.Get("Allow"))
+			}
+		})
+	}
+}
+
+// The framing and header checks only fire on requests that did not come
+// straight from the net/http server, such as those altered by other handlers.
+func TestProtocolChecker_DefenceInDepth(t *testing.T) {
+	checker, err := newProtocolChecker(&Config{ProtocolChecks: []string{protocolChecksAll}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		alter    func(req *http.Request)
+		expected string
+	}{
+		{
+			name: "Content-Length and Transfer-Encoding",
+			alter: func(req *http.Request) {
+				req.TransferEncoding = []string{"chunked"}
+				req.Header.Set("Content-Length", "4")
+			},
+			expected: checkConflictingLength,
+		},
+		{
+			name:     "Content-Length list",
+			alter:    func(req *http.Request) { req.Header["Content-Length"] = []string{"4, 12"} },
+			expected: checkDuplicateContentLength,
+		},
+		{
+			name:     "Invalid header name",
+			alter:    func(req *http.Request) { req.Header["X-Forwarded-For "] = []string{"10.0.0.1"} },
+			expected: checkInvalidHeaderName,
+		},
+		{
+			name:     "Invalid header value",
+			alter:    func(req *http.Request) { req.Header.Set("X-Forwarded-Host", "example.com\r\nX-Admin: 1") },
+			expected: checkInvalidHeaderValue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			tt.alter(req)
+			assert.Equal(t, tt.expected, checker.check(req))
+		})
+	}
+}
+
+func TestNewProtocolChecker_Errors(t *testing.T) {
+	_, err := newProtocolChecker(&Config{ProtocolChecks: []string{"request-smuggling"}})
+	assert.Error(t, err)
+
+	checker, err := newProtocolChecker(&Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, checker)
+}
@@ -0,0 +1,114 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"strings"
+)
+
+// requestLimit is a cheap check on the request line and the headers. The
+// reason is logged and counted when the limit is exceeded.
+type requestLimit struct {
+	reason  string
+	status  int
+	max     int
+	measure func(req *http.Request) int
+}
+
+// newRequestLimits returns the configured limits, checked before the body
+// is buffered and the WAF is called.
+func newRequestLimits(config *Config) []requestLimit {
+	all := []requestLimit{
+		{"uri-too-long", http.StatusRequestURITooLong, config.MaxUriLength, uriLength},
+		{"query-too-long", http.StatusRequestURITooLong, config.MaxQueryLength, queryLength},
+		{"too-many-args", http.StatusBadRequest, config.MaxArgCount, argCount},
+		{"too-many-headers", http.StatusRequestHeaderFieldsTooLarge, config.MaxHeaderCount, headerCount},
+		{"header-too-large", http.StatusRequestHeaderFieldsTooLarge, config.MaxHeaderSize, largestHeaderSize},
+		{"headers-too-large", http.StatusRequestHeaderFieldsTooLarge, config.MaxTotalHeaderSize, totalHeaderSize},
+		{"too-many-cookies", http.StatusRequestHeaderFieldsTooLarge, config.MaxCookieCount, cookieCount},
+	}
+
+	var limits []requestLimit
+	for _, l := range all {
+		if l.max > 0 {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
+
+// limitExceeded answers the requests exceeding one of the limits.
+func (a *Modsecurity) limitExceeded(rw http.ResponseWriter, req *http.Request) bool {
+	for _, l := range a.requestLimits {
+		value := l.measure(req)
+		if value <= l.max {
+			continue
+		}
+		a.metrics.inc("limit_exceeded_" + l.reason)
+		a.logger.Printf("request limit %s exceeded (%d > %d) for %s %s from %s", l.reason, value, l.max, req.Method, req.URL.Path, req.RemoteAddr)
+		a.emit(a.newEvent(req, eventActionBlock, "limit "+l.reason, l.status))
+		http.Error(rw, "", l.status)
+		return true
+	}
+	return false
+}
+
+func uriLength(req *http.Request) int {
+	if req.RequestURI != "" {
+		return len(req.RequestURI)
+	}
+	return len(req.URL.RequestURI())
+}
+
+func queryLength(req *http.Request) int {
+	return len(req.URL.RawQuery)
+}
+
+// argCount counts the query parameters without decoding them.
+func argCount(req *http.Request) int {
+	count := 0
+	for _, pair := range strings.Split(req.URL.RawQuery, "&") {
+		if pair != "" {
+			count++
+		}
+	}
+	return count
+}
+
+func headerCount(req *http.Request) int {
+	count := 0
+	for _, values := range req.Header {
+		count += len(values)
+	}
+	return count
+}
+
+// headerSize is the size of a "name: value" header line.
+func headerSize(name, value string) int {
+	return len(name) + 2 + len(value)
+}
+
+func largestHeaderSize(req *http.Request) int {
+	largest := 0
+	for name, values := range req.Header {
+		for _, v := range values {
+			if size := headerSize(name, v); size > largest {
+				largest = size
+			}
+		}
+	}
+	return largest
+}
+
+func totalHeaderSize(req *http.Request) int {
+	total := 0
+	for name, values := range req.Header {
+		for _, v := range values {
+			total += headerSize(name, v)
+		}
+	}
+	return total
+}
+
+func cookieCount(req *http.Request) int {
+	return len(req.Cookies())
+}
@@ -0,0 +1,127 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ServeHTTP_RequestLimits(t *testing.T) {
+	wafCalls := 0
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+	}))
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = modsecurityMockServer.URL
+	config.MaxUriLength = 64
+	config.MaxQueryLength = 40
+	config.MaxArgCount = 3
+	config.MaxHeaderCount = 5
+	config.MaxHeaderSize = 100
+	config.MaxTotalHeaderSize = 200
+	config.MaxCookieCount = 2
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware := handler.(*Modsecurity)
+	middleware.logger = log.New(io.Discard, "", log.LstdFlags)
+
+	tests := []struct {
+		name           string
+		target         string
+		headers        map[string][]string
+		expectedStatus int
+		expectedReason string
+	}{
+		{
+			name:           "Within the limits",
+			target:         "/search?q=waf&page=2",
+			headers:        map[string][]string{"Cookie": {"session=abc; theme=dark"}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "URI too long",
+			target:         "/" + strings.Repeat("a", 64),
+			expectedStatus: http.StatusRequestURITooLong,
+			expectedReason: "uri-too-long",
+		},
+		{
+			name:           "Query too long",
+			target:         "/?q=" + strings.Repeat("a", 40),
+			expectedStatus: http.StatusRequestURITooLong,
+			expectedReason: "query-too-long",
+		},
+		{
+			name:           "Too many args",
+			target:         "/?a=1&b=2&c=3&a=4",
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: "too-many-args",
+		},
+		{
+			name:           "Too many headers",
+			target:         "/",
+			headers:        map[string][]string{"X-Forwarded-For": {"10.0.0.1", "10.0.0.2", "10.0.0.3"}, "Accept": {"*/*"}, "X-Trace": {"1", "2"}},
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+			expectedReason: "too-many-headers",
+		},
+		{
+			name:           "Header too large",
+			target:         "/",
+			headers:        map[string][]string{"Authorization": {"Bearer " + strings.Repeat("x", 90)}},
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+			expectedReason: "header-too-large",
+		},
+		{
+			name:           "Headers too large",
+			target:         "/",
+			headers:        map[string][]string{"X-A": {strings.Repeat("a", 80)}, "X-B": {strings.Repeat("b", 80)}, "X-C": {strings.Repeat("c", 80)}},
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+			expectedReason: "headers-too-large",
+		},
+		{
+			name:           "Too many cookies",
+			target:         "/",
+			headers:        map[string][]string{"Cookie": {"a=1; b=2; c=3"}},
+			expectedStatus: http.StatusRequestHeaderFieldsTooLarge,
+			expectedReason: "too-many-cookies",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCalls = 0
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for name, values := range tt.headers {
+				req.Header[name] = values
+			}
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.expectedStatus, rw.Code)
+			if tt.expectedReason == "" {
+				assert.Equal(t, 1, wafCalls)
+				return
+			}
+			assert.Equal(t, 0, wafCalls)
+			assert.Equal(t, int64(1), middleware.metrics.get("limit_exceeded_"+tt.expectedReason))
+		})
+	}
+}
+
+func TestNewRequestLimits(t *testing.T) {
+	assert.Empty(t, newRequestLimits(CreateConfig()))
+
+	limits := newRequestLimits(&Config{MaxUriLength: 2048, MaxCookieCount: 50})
+	assert.Len(t, limits, 2)
+	assert.Equal(t, "uri-too-long", limits[0].reason)
+	assert.Equal(t, "too-many-cookies", limits[1].reason)
+}
@@ -0,0 +1,99 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are meaningful for a single connection only and must not
+// be forwarded (RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// defaultStrippedHeaders identify the WAF, Content-Length is recomputed by the
+// server as the body may be truncated.
+var defaultStrippedHeaders = []string{"Server", "X-Powered-By", "Content-Length"}
+
+const defaultMaxResponseBodySize = 1024 * 1024
+
+// responsePolicy decides what part of a WAF block response reaches the client.
+type responsePolicy struct {
+	allowed     map[string]bool
+	stripped    map[string]bool
+	maxBodySize int64
+}
+
+var defaultResponsePolicy = newResponsePolicy(&Config{})
+
+func newResponsePolicy(config *Config) *responsePolicy {
+	p := &responsePolicy{
+		stripped:    make(map[string]bool),
+		maxBodySize: config.MaxResponseBodySize,
+	}
+	if p.maxBodySize <= 0 {
+		p.maxBodySize = defaultMaxResponseBodySize
+	}
+	stripped := append(append(hopByHopHeaders, defaultStrippedHeaders...), config.ResponseHeadersStrip...)
+	stripped = append(stripped, ruleIDsHeader(config), scoreHeader(config))
+	for _, h := range stripped {
+		p.stripped[http.CanonicalHeaderKey(h)] = true
+	}
+	if len(config.ResponseHeadersAllowlist) > 0 {
+		p.allowed = make(map[string]bool)
+		for _, h := range config.ResponseHeadersAllowlist {
+			p.allowed[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return p
+}
+
+func (p *responsePolicy) keep(header string, connectionHeaders map[string]bool) bool {
+	if p.stripped[header] || connectionHeaders[header] {
+		return false
+	}
+	return p.allowed == nil || p.allowed[header]
+}
+
+// forward copies resp to rw according to the policy. A nil policy uses the
+// defaults.
+func (p *responsePolicy) forward(resp *http.Response, rw http.ResponseWriter) {
+	if p == nil {
+		p = defaultResponsePolicy
+	}
+
+	// headers listed in Connection are hop-by-hop as well
+	connectionHeaders := make(map[string]bool)
+	for _, v := range resp.Header["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			connectionHeaders[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+		}
+	}
+
+	// copy headers
+	for k, vv := range resp.Header {
+		if !p.keep(http.CanonicalHeaderKey(k), connectionHeaders) {
+			continue
+		}
+		for _, v := range vv {
+			rw.Header().Add(k, v)
+		}
+	}
+	// copy status
+	rw.WriteHeader(resp.StatusCode)
+	// copy body
+	io.Copy(rw, io.LimitReader(resp.Body, p.maxBodySize))
+}
+
+func forwardResponse(resp *http.Response, rw http.ResponseWriter) {
+	defaultResponsePolicy.forward(resp, rw)
+}
@@ -0,0 +1,93 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponsePolicy_Forward(t *testing.T) {
+	wafHeaders := func() http.Header {
+		return http.Header{
+			"Set-Cookie":     []string{"a=1", "b=2"},
+			"Vary":           []string{"Accept", "Accept-Encoding"},
+			"Content-Type":   []string{"text/html"},
+			"Content-Length": []string{"9999"},
+			"Server":         []string{"Apache"},
+			"X-Powered-By":   []string{"ModSecurity"},
+			"Connection":     []string{"keep-alive, X-Waf-Debug"},
+			"Keep-Alive":     []string{"timeout=5"},
+			"X-Waf-Debug":    []string{"rule 942100"},
+			"X-Request-Id":   []string{"42"},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		config       Config
+		body         string
+		expectHeader http.Header
+		expectBody   string
+	}{
+		{
+			name: "Strips hop-by-hop and WAF headers and keeps multi-valued headers",
+			body: "Forbidden",
+			expectHeader: http.Header{
+				"Set-Cookie":   []string{"a=1", "b=2"},
+				"Vary":         []string{"Accept", "Accept-Encoding"},
+				"Content-Type": []string{"text/html"},
+				"X-Request-Id": []string{"42"},
+			},
+			expectBody: "Forbidden",
+		},
+		{
+			name:   "Keeps only allowlisted headers",
+			config: Config{ResponseHeadersAllowlist: []string{"content-type", "server"}},
+			body:   "Forbidden",
+			expectHeader: http.Header{
+				"Content-Type": []string{"text/html"},
+			},
+			expectBody: "Forbidden",
+		},
+		{
+			name:   "Strips configured headers",
+			config: Config{ResponseHeadersStrip: []string{"x-request-id", "set-cookie"}},
+			body:   "Forbidden",
+			expectHeader: http.Header{
+				"Vary":         []string{"Accept", "Accept-Encoding"},
+				"Content-Type": []string{"text/html"},
+			},
+			expectBody: "Forbidden",
+		},
+		{
+			name:   "Caps the body size",
+			config: Config{MaxResponseBodySize: 4, ResponseHeadersAllowlist: []string{"Content-Type"}},
+			body:   strings.Repeat("x", 100),
+			expectHeader: http.Header{
+				"Content-Type": []string{"text/html"},
+			},
+			expectBody: "xxxx",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusForbidden,
+				Header:     wafHeaders(),
+				Body:       io.NopCloser(bytes.NewBufferString(tt.body)),
+			}
+
+			rw := httptest.NewRecorder()
+			newResponsePolicy(&tt.config).forward(resp, rw)
+
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Equal(t, tt.expectHeader, rw.Header())
+			assert.Equal(t, tt.expectBody, rw.Body.String())
+		})
+	}
+}
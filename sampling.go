@@ -0,0 +1,64 @@
+package traefik_modsecurity_plugin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+)
+
+// sampler decides which requests are inspected by the WAF. The decision is a
+// hash of the client IP, or of the session cookie when present, so a client
+// is consistently inspected or not.
+type sampler struct {
+	// threshold over 10000 buckets, i.e. rate in hundredths of percent
+	threshold            uint32
+	cookie               string
+	alwaysInspectBody    bool
+	alwaysInspectMethods bool
+}
+
+// newSampler returns nil when every request must be inspected.
+func newSampler(config *Config) (*sampler, error) {
+	if config.SamplingRate < 0 || config.SamplingRate > 100 {
+		return nil, fmt.Errorf("samplingRate must be between 0 and 100, got %v", config.SamplingRate)
+	}
+	if config.SamplingRate == 100 {
+		return nil, nil
+	}
+	return &sampler{
+		threshold:            uint32(config.SamplingRate * 100),
+		cookie:               config.SamplingCookie,
+		alwaysInspectBody:    config.SamplingAlwaysInspectBody,
+		alwaysInspectMethods: config.SamplingAlwaysInspectNonGet,
+	}, nil
+}
+
+func (s *sampler) sampled(req *http.Request) bool {
+	if s == nil {
+		return true
+	}
+	if s.alwaysInspectBody && (req.ContentLength != 0 || len(req.TransferEncoding) > 0) {
+		return true
+	}
+	if s.alwaysInspectMethods && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(s.key(req)))
+	return h.Sum32()%10000 < s.threshold
+}
+
+func (s *sampler) key(req *http.Request) string {
+	if s.cookie != "" {
+		if cookie, err := req.Cookie(s.cookie); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "ip:" + req.RemoteAddr
+	}
+	return "ip:" + host
+}
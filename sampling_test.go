@@ -0,0 +1,128 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler_Sampled(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		request func() *http.Request
+		expect  bool
+	}{
+		{
+			name:   "Skips every client at 0%",
+			config: Config{SamplingRate: 0},
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/", nil)
+			},
+			expect: false,
+		},
+		{
+			name:   "Always inspects requests with a body",
+			config: Config{SamplingRate: 0, SamplingAlwaysInspectBody: true},
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPut, "/", bytes.NewBufferString("Request"))
+			},
+			expect: true,
+		},
+		{
+			name:   "Always inspects non GET methods",
+			config: Config{SamplingRate: 0, SamplingAlwaysInspectNonGet: true},
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodDelete, "/", nil)
+			},
+			expect: true,
+		},
+		{
+			name:   "Does not force GET requests without body",
+			config: Config{SamplingRate: 0, SamplingAlwaysInspectBody: true, SamplingAlwaysInspectNonGet: true},
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/", nil)
+			},
+			expect: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSampler(&tt.config)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expect, s.sampled(tt.request()))
+		})
+	}
+}
+
+func TestSampler_Deterministic(t *testing.T) {
+	s, err := newSampler(&Config{SamplingRate: 50, SamplingCookie: "session"})
+	assert.NoError(t, err)
+
+	inspected := 0
+	for i := 0; i < 1000; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		first := s.sampled(req)
+
+		// same client from another port, then with a session cookie
+		req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:4321", i/256, i%256)
+		assert.Equal(t, first, s.sampled(req))
+		if first {
+			inspected++
+		}
+	}
+	assert.InDelta(t, 500, inspected, 100)
+
+	withCookie := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		return req
+	}
+	assert.Equal(t, s.sampled(withCookie("10.0.0.1:1")), s.sampled(withCookie("192.168.0.1:1")))
+}
+
+func TestNewSampler_InvalidRate(t *testing.T) {
+	_, err := newSampler(&Config{SamplingRate: 101})
+	assert.Error(t, err)
+
+	s, err := newSampler(&Config{SamplingRate: 100})
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+func TestModsecurity_ServeHTTP_Unsampled(t *testing.T) {
+	wafCalls := 0
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafCalls++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	s, _ := newSampler(&Config{SamplingRate: 0})
+	middleware := &Modsecurity{
+		next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		modSecurityUrl: modsecurityMockServer.URL,
+		maxBodySize:    1024,
+		name:           "modsecurity-middleware",
+		httpClient:     http.DefaultClient,
+		logger:         log.New(io.Discard, "", log.LstdFlags),
+		sampler:        s,
+		metrics:        newMetrics(),
+	}
+
+	rw := httptest.NewRecorder()
+	middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 0, wafCalls)
+	assert.Equal(t, int64(1), middleware.metrics.get("requests_unsampled"))
+	assert.Equal(t, int64(0), middleware.metrics.get("requests_inspected"))
+}
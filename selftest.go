@@ -0,0 +1,110 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// selfTest periodically checks that the WAF still blocks a known-malicious
+// request and allows a known-benign one.
+type selfTest struct {
+	maliciousPath string
+	benignPath    string
+	interval      time.Duration
+	timeout       time.Duration
+	refuse        bool
+
+	// passing is 1 while the WAF verdicts are the expected ones
+	passing int32
+}
+
+func newSelfTest(config *Config) *selfTest {
+	if config.SelfTestIntervalMillis <= 0 {
+		return nil
+	}
+	s := &selfTest{
+		maliciousPath: config.SelfTestMaliciousPath,
+		benignPath:    config.SelfTestBenignPath,
+		interval:      time.Duration(config.SelfTestIntervalMillis) * time.Millisecond,
+		timeout:       millisOrDefault(config.SelfTestTimeoutMillis, 2*time.Second),
+		refuse:        config.SelfTestRefuseTraffic,
+		passing:       1,
+	}
+	if s.maliciousPath == "" {
+		s.maliciousPath = "/?test=../../etc/passwd"
+	}
+	if s.benignPath == "" {
+		s.benignPath = "/"
+	}
+	return s
+}
+
+func (s *selfTest) isPassing() bool {
+	return s == nil || atomic.LoadInt32(&s.passing) == 1
+}
+
+// startSelfTest runs the self-test right away and then every interval until
+// ctx is done.
+func (a *Modsecurity) startSelfTest(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(a.selfTest.interval)
+		defer ticker.Stop()
+		for {
+			a.runSelfTest(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (a *Modsecurity) runSelfTest(ctx context.Context) {
+	s := a.selfTest
+
+	err := a.checkVerdict(ctx, s.maliciousPath, true)
+	if err == nil {
+		err = a.checkVerdict(ctx, s.benignPath, false)
+	}
+
+	if err != nil {
+		atomic.StoreInt32(&s.passing, 0)
+		a.metrics.set("selftest_passing", 0)
+		a.metrics.inc("selftest_failures")
+		a.logger.Printf("SELF-TEST FAILED: modsec does not give the expected verdicts, it may not be protecting %s: %s", a.name, err.Error())
+		return
+	}
+
+	if atomic.SwapInt32(&s.passing, 1) == 0 {
+		a.logger.Printf("self-test passed again: modsec gives the expected verdicts")
+	}
+	a.metrics.set("selftest_passing", 1)
+}
+
+func (a *Modsecurity) checkVerdict(ctx context.Context, path string, expectBlocked bool) error {
+	status, err := a.wafStatus(ctx, path, a.selfTest.timeout)
+	if err != nil {
+		return err
+	}
+	if blocked := status >= 400; blocked != expectBlocked {
+		return fmt.Errorf("%s answered %d, expected blocked=%t", path, status, expectBlocked)
+	}
+	return nil
+}
+
+// selfTestFailed refuses traffic while the self-test fails, if configured to.
+// It returns true when the request was answered.
+func (a *Modsecurity) selfTestFailed(rw http.ResponseWriter) bool {
+	if a.selfTest.isPassing() || !a.selfTest.refuse {
+		return false
+	}
+	a.metrics.inc("requests_selftest_rejected")
+	rw.Header().Set("Retry-After", strconv.Itoa(a.retryAfter))
+	http.Error(rw, "", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,74 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_RunSelfTest(t *testing.T) {
+	tests := []struct {
+		name          string
+		waf           func(w http.ResponseWriter, r *http.Request)
+		expectPassing bool
+	}{
+		{
+			name: "Passes when the WAF blocks the attack only",
+			waf: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("test") != "" {
+					w.WriteHeader(http.StatusForbidden)
+				}
+			},
+			expectPassing: true,
+		},
+		{
+			name:          "Fails when the WAF allows everything",
+			waf:           func(w http.ResponseWriter, r *http.Request) {},
+			expectPassing: false,
+		},
+		{
+			name: "Fails when the WAF blocks everything",
+			waf: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+			},
+			expectPassing: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modsecurityMockServer := httptest.NewServer(http.HandlerFunc(tt.waf))
+			defer modsecurityMockServer.Close()
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     http.DefaultClient,
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+				metrics:        newMetrics(),
+				selfTest:       newSelfTest(&Config{SelfTestIntervalMillis: 1000, SelfTestRefuseTraffic: true}),
+				retryAfter:     1,
+			}
+
+			middleware.runSelfTest(context.Background())
+			assert.Equal(t, tt.expectPassing, middleware.selfTest.isPassing())
+
+			rw := httptest.NewRecorder()
+			middleware.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+			if tt.expectPassing {
+				assert.Equal(t, int64(1), middleware.metrics.get("selftest_passing"))
+				assert.Equal(t, http.StatusOK, rw.Code)
+			} else {
+				assert.Equal(t, int64(0), middleware.metrics.get("selftest_passing"))
+				assert.Equal(t, int64(1), middleware.metrics.get("selftest_failures"))
+				assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFormatCEF  = "cef"
+	syslogFormatLEEF = "leef"
+
+	syslogVendor  = "acouvreur"
+	syslogProduct = "traefik-modsecurity-plugin"
+	syslogVersion = "1.0"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSink sends the events to a syslog server with RFC 5424 framing, the
+// message being formatted as CEF or LEEF for SIEM ingestion.
+type syslogSink struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	format    string
+	hostname  string
+	appName   string
+	events    chan event
+	conn      net.Conn
+	metrics   *metrics
+	logger    *log.Logger
+}
+
+func newSyslogSink(config *Config, m *metrics, logger *log.Logger) (*syslogSink, error) {
+	if config.SyslogAddress == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(config.SyslogAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslogAddress: %w", err)
+	}
+	s := &syslogSink{
+		address:  u.Host,
+		format:   config.SyslogFormat,
+		appName:  config.SyslogAppName,
+		events:   make(chan event, intOrDefault(config.SyslogBufferSize, 10000)),
+		metrics:  m,
+		logger:   logger,
+		hostname: "-",
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.network = u.Scheme
+	case "tls":
+		s.network = "tcp"
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if config.SyslogTLSCA != "" {
+			pool, err := (&rootsSource{ca: newPEMSource(config.SyslogTLSCA)}).pool()
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslogAddress scheme %q, use udp, tcp or tls", u.Scheme)
+	}
+
+	switch s.format {
+	case "":
+		s.format = syslogFormatCEF
+	case syslogFormatCEF, syslogFormatLEEF:
+	default:
+		return nil, fmt.Errorf("unsupported syslogFormat %q", config.SyslogFormat)
+	}
+
+	s.facility = syslogFacilities["local0"]
+	if config.SyslogFacility != "" {
+		facility, ok := syslogFacilities[config.SyslogFacility]
+		if !ok {
+			return nil, fmt.Errorf("unsupported syslogFacility %q", config.SyslogFacility)
+		}
+		s.facility = facility
+	}
+
+	if s.appName == "" {
+		s.appName = "traefik-modsecurity"
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		s.hostname = hostname
+	}
+	return s, nil
+}
+
+func (s *syslogSink) send(ev event) {
+	select {
+	case s.events <- ev:
+	default:
+		s.metrics.inc("syslog_dropped")
+	}
+}
+
+func (s *syslogSink) run(ctx context.Context) {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-s.events:
+			s.write(s.frame(ev))
+		}
+	}
+}
+
+// write sends a message, reconnecting once if the connection was lost.
+func (s *syslogSink) write(msg []byte) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				s.logger.Printf("syslog: fail to connect to %s: %s", s.address, err.Error())
+				break
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := s.conn.Write(msg); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			continue
+		}
+		s.metrics.inc("syslog_sent")
+		return
+	}
+	s.metrics.inc("syslog_dropped")
+}
+
+func (s *syslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if s.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, s.network, s.address, s.tlsConfig)
+	}
+	return dialer.Dial(s.network, s.address)
+}
+
+// frame builds the RFC 5424 message. Stream transports use the octet
+// counting framing of RFC 6587.
+func (s *syslogSink) frame(ev event) []byte {
+	severity := 4 // warning
+	if ev.Action == eventActionError {
+		severity = 3 // error
+	}
+	msgID := strings.ToUpper(ev.Action)
+
+	var payload string
+	if s.format == syslogFormatLEEF {
+		payload = formatLEEF(ev)
+	} else {
+		payload = formatCEF(ev)
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s - %s - %s",
+		s.facility*8+severity,
+		ev.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname, s.appName, msgID, payload)
+
+	if s.network == "udp" {
+		return []byte(msg)
+	}
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
+
+// eventSeverity maps an event to the 0-10 scale of CEF and LEEF.
+func eventSeverity(ev event) int {
+	switch {
+	case ev.Action == eventActionError:
+		return 5
+	case ev.Score >= 20:
+		return 10
+	case ev.Score >= 10:
+		return 9
+	default:
+		return 8
+	}
+}
+
+func eventSignature(ev event) string {
+	if len(ev.RuleIDs) > 0 {
+		return ev.RuleIDs[0]
+	}
+	return ev.Action
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+	leefEscaper         = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+func formatCEF(ev event) string {
+	name := "WAF " + ev.Action
+	if ev.Reason != "" {
+		name += ": " + ev.Reason
+	}
+
+	extensions := []string{
+		"rt=" + strconv.FormatInt(ev.Time.UnixNano()/int64(time.Millisecond), 10),
+		"src=" + cefExtensionEscaper.Replace(ev.ClientIP),
+		"requestMethod=" + cefExtensionEscaper.Replace(ev.Method),
+		"dhost=" + cefExtensionEscaper.Replace(ev.Host),
+		"request=" + cefExtensionEscaper.Replace(ev.URI),
+		"act=" + cefExtensionEscaper.Replace(ev.Action),
+		"outcome=" + strconv.Itoa(ev.Status),
+		"cs1Label=ruleIds",
+		"cs1=" + cefExtensionEscaper.Replace(strings.Join(ev.RuleIDs, ",")),
+		"cs2Label=middleware",
+		"cs2=" + cefExtensionEscaper.Replace(ev.Middleware),
+		"cn1Label=anomalyScore",
+		"cn1=" + strconv.Itoa(ev.Score),
+	}
+
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		syslogVendor, syslogProduct, syslogVersion,
+		cefHeaderEscaper.Replace(eventSignature(ev)),
+		cefHeaderEscaper.Replace(name),
+		eventSeverity(ev),
+		strings.Join(extensions, " "))
+}
+
+func formatLEEF(ev event) string {
+	attributes := []string{
+		"devTime=" + ev.Time.UTC().Format("Jan 02 2006 15:04:05"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss",
+		"cat=" + ev.Action,
+		"sev=" + strconv.Itoa(eventSeverity(ev)),
+		"src=" + ev.ClientIP,
+		"method=" + ev.Method,
+		"dsthost=" + ev.Host,
+		"url=" + ev.URI,
+		"action=" + ev.Action,
+		"reason=" + ev.Reason,
+		"status=" + strconv.Itoa(ev.Status),
+		"ruleIds=" + strings.Join(ev.RuleIDs, ","),
+		"anomalyScore=" + strconv.Itoa(ev.Score),
+		"middleware=" + ev.Middleware,
+	}
+	for i, attr := range attributes {
+		attributes[i] = leefEscaper.Replace(attr)
+	}
+
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|%s",
+		syslogVendor, syslogProduct, syslogVersion,
+		leefEscaper.Replace(strings.ReplaceAll(eventSignature(ev), "|", " ")),
+		strings.Join(attributes, "\t"))
+}
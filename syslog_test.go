@@ -0,0 +1,167 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEvent() event {
+	return event{
+		Time:       time.Date(2024, 5, 22, 6, 5, 0, 0, time.UTC),
+		Middleware: "waf@docker",
+		Action:     eventActionBlock,
+		Reason:     "waf",
+		ClientIP:   "172.18.0.1",
+		Method:     "GET",
+		Host:       "localhost:8000",
+		URI:        "/website?test=../etc&a=b|c",
+		Status:     403,
+		RuleIDs:    []string{"930100", "949110"},
+		Score:      10,
+	}
+}
+
+func TestFormatCEF(t *testing.T) {
+	assert.Equal(t,
+		`CEF:0|acouvreur|traefik-modsecurity-plugin|1.0|930100|WAF block: waf|9|`+
+			`rt=1716357900000 src=172.18.0.1 requestMethod=GET dhost=localhost:8000 request=/website?test\=../etc&a\=b|c `+
+			`act=block outcome=403 cs1Label=ruleIds cs1=930100,949110 cs2Label=middleware cs2=waf@docker cn1Label=anomalyScore cn1=10`,
+		formatCEF(testEvent()))
+}
+
+func TestFormatLEEF(t *testing.T) {
+	ev := testEvent()
+	ev.Reason = "line\nbreak"
+
+	assert.Equal(t,
+		"LEEF:1.0|acouvreur|traefik-modsecurity-plugin|1.0|930100|"+
+			"devTime=May 22 2024 06:05:00\tdevTimeFormat=MMM dd yyyy HH:mm:ss\tcat=block\tsev=9\tsrc=172.18.0.1\t"+
+			"method=GET\tdsthost=localhost:8000\turl=/website?test=../etc&a=b|c\taction=block\treason=line break\t"+
+			"status=403\truleIds=930100,949110\tanomalyScore=10\tmiddleware=waf@docker",
+		formatLEEF(ev))
+}
+
+func TestSyslogSink_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := newSyslogSink(&Config{
+		SyslogAddress:  "udp://" + conn.LocalAddr().String(),
+		SyslogFacility: "local4",
+		SyslogFormat:   syslogFormatLEEF,
+	}, newMetrics(), log.New(io.Discard, "", log.LstdFlags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.hostname = "traefik"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.run(ctx)
+	sink.send(testEvent())
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// local4 (20) * 8 + warning (4)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "<164>1 2024-05-22T06:05:00Z traefik traefik-modsecurity - BLOCK - LEEF:1.0|"), string(buf[:n]))
+}
+
+func TestSyslogSink_TLS(t *testing.T) {
+	ca := generateCertificate(t, "ca", nil)
+	serverCert := generateCertificate(t, "syslog", ca)
+	pair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			// octet counting framing: "<length> <message>"
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				return
+			}
+			messages <- string(msg)
+		}
+	}()
+
+	sink, err := newSyslogSink(&Config{
+		SyslogAddress: "tls://" + listener.Addr().String(),
+		SyslogTLSCA:   string(ca.certPEM),
+	}, newMetrics(), log.New(io.Discard, "", log.LstdFlags))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.run(ctx)
+
+	errorEvent := testEvent()
+	errorEvent.Action = eventActionError
+	sink.send(testEvent())
+	sink.send(errorEvent)
+
+	for _, expect := range []string{"<132>1 ", "<131>1 "} {
+		select {
+		case msg := <-messages:
+			assert.True(t, strings.HasPrefix(msg, expect), msg)
+			assert.Contains(t, msg, "CEF:0|acouvreur|traefik-modsecurity-plugin|")
+		case <-time.After(2 * time.Second):
+			t.Fatal("syslog message not received")
+		}
+	}
+}
+
+func TestNewSyslogSink_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Unknown scheme", config: Config{SyslogAddress: "http://127.0.0.1:514"}},
+		{name: "Unknown format", config: Config{SyslogAddress: "udp://127.0.0.1:514", SyslogFormat: "json"}},
+		{name: "Unknown facility", config: Config{SyslogAddress: "udp://127.0.0.1:514", SyslogFacility: "local9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSyslogSink(&tt.config, nil, nil)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package traefik_modsecurity_plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration used for https:// modsecurity
+// URLs. It returns nil when no TLS option is configured so that the transport
+// keeps its defaults (system roots, no client certificate).
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCA == "" && config.TLSCert == "" && config.TLSKey == "" &&
+		config.TLSServerName == "" && config.TLSMinVersion == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if config.TLSMinVersion != "" {
+		version, ok := tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tlsMinVersion %q", config.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("tlsCert and tlsKey must be set together")
+	}
+
+	if config.TLSCert != "" {
+		certs := &certificateSource{cert: newPEMSource(config.TLSCert), key: newPEMSource(config.TLSKey)}
+		if _, err := certs.certificate(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.certificate()
+		}
+	}
+
+	if config.TLSCA != "" {
+		roots := &rootsSource{ca: newPEMSource(config.TLSCA)}
+		if _, err := roots.pool(); err != nil {
+			return nil, err
+		}
+		serverName := config.TLSServerName
+		if serverName == "" {
+			u, err := url.Parse(config.ModSecurityUrl)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modSecurityUrl: %w", err)
+			}
+			serverName = u.Hostname()
+		}
+		// The standard verification cannot reload its roots, so it is done in
+		// VerifyConnection with the current pool instead.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			pool, err := roots.pool()
+			if err != nil {
+				return err
+			}
+			return verifyConnection(state, pool, serverName)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func verifyConnection(state tls.ConnectionState, pool *x509.CertPool, serverName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("modsecurity did not present any certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// fileSource is either inline content or a path to a file. Files are read
+// again whenever their modification time changes so that rotated
+// certificates or updated lists are picked up without restarting Traefik.
+type fileSource struct {
+	inline []byte
+	path   string
+
+	mu      sync.Mutex
+	modTime time.Time
+	data    []byte
+}
+
+// newPEMSource returns a source for an inline PEM block or a PEM file path.
+func newPEMSource(value string) *fileSource {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return &fileSource{inline: []byte(value)}
+	}
+	return &fileSource{path: value}
+}
+
+// load returns the current content and whether it changed since last call.
+func (s *fileSource) load() ([]byte, bool, error) {
+	if s.inline != nil {
+		return s.inline, false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, false, fmt.Errorf("fail to stat %s: %w", s.path, err)
+	}
+	if s.data != nil && info.ModTime().Equal(s.modTime) {
+		return s.data, false, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, false, fmt.Errorf("fail to read %s: %w", s.path, err)
+	}
+	s.data = data
+	s.modTime = info.ModTime()
+	return data, true, nil
+}
+
+type certificateSource struct {
+	cert, key *fileSource
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	stale   bool
+}
+
+func (s *certificateSource) certificate() (*tls.Certificate, error) {
+	certPEM, certChanged, err := s.cert.load()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, keyChanged, err := s.key.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && !certChanged && !keyChanged && !s.stale {
+		return s.current, nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		// keep serving the previous pair while a rotation is half written
+		if s.current != nil {
+			s.stale = true
+			return s.current, nil
+		}
+		return nil, fmt.Errorf("fail to load client certificate: %w", err)
+	}
+	s.current = &cert
+	s.stale = false
+	return s.current, nil
+}
+
+type rootsSource struct {
+	ca *fileSource
+
+	mu      sync.Mutex
+	current *x509.CertPool
+}
+
+func (s *rootsSource) pool() (*x509.CertPool, error) {
+	caPEM, changed, err := s.ca.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil && !changed {
+		return s.current, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		if s.current != nil {
+			return s.current, nil
+		}
+		return nil, fmt.Errorf("no certificate found in tlsCA")
+	}
+	s.current = pool
+	return s.current, nil
+}
@@ -0,0 +1,249 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func generateCertificate(t *testing.T, cn string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMutualTLSServer starts a WAF mock that requires a client certificate
+// signed by ca and records the common name of the last client.
+func newMutualTLSServer(t *testing.T, ca *testCertificate) (*httptest.Server, func() string) {
+	serverCert := generateCertificate(t, "waf", ca)
+	pair, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	var mu sync.Mutex
+	var lastClient string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		lastClient = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return lastClient
+	}
+}
+
+func TestNew_MutualTLS(t *testing.T) {
+	ca := generateCertificate(t, "ca", nil)
+	client := generateCertificate(t, "client", ca)
+	server, lastClient := newMutualTLSServer(t, ca)
+
+	config := CreateConfig()
+	config.ModSecurityUrl = server.URL
+	config.TLSCA = string(ca.certPEM)
+	config.TLSCert = string(client.certPEM)
+	config.TLSKey = string(client.keyPEM)
+	config.TLSMinVersion = "1.3"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "client", lastClient())
+}
+
+func TestNew_TLSUnknownAuthority(t *testing.T) {
+	ca := generateCertificate(t, "ca", nil)
+	other := generateCertificate(t, "other", nil)
+	client := generateCertificate(t, "client", ca)
+	server, _ := newMutualTLSServer(t, ca)
+
+	config := CreateConfig()
+	config.ModSecurityUrl = server.URL
+	config.TLSCA = string(other.certPEM)
+	config.TLSCert = string(client.certPEM)
+	config.TLSKey = string(client.keyPEM)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestNewTLSConfig_ReloadsRotatedFiles(t *testing.T) {
+	ca := generateCertificate(t, "ca", nil)
+	first := generateCertificate(t, "first", ca)
+	second := generateCertificate(t, "second", ca)
+	server, lastClient := newMutualTLSServer(t, ca)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	now := time.Now()
+	writeFile(t, caFile, ca.certPEM, now)
+	writeFile(t, certFile, first.certPEM, now)
+	writeFile(t, keyFile, first.keyPEM, now)
+
+	transport, err := newTransport(&Config{
+		ModSecurityUrl: server.URL,
+		TLSCA:          caFile,
+		TLSCert:        certFile,
+		TLSKey:         keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	resp, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, "first", lastClient())
+
+	later := now.Add(time.Minute)
+	writeFile(t, certFile, second.certPEM, later)
+	writeFile(t, keyFile, second.keyPEM, later)
+	transport.CloseIdleConnections()
+
+	resp, err = httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, "second", lastClient())
+}
+
+func TestNewTLSConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{
+			name:   "Unknown minimum version",
+			config: Config{TLSMinVersion: "2.0"},
+		},
+		{
+			name:   "Certificate without key",
+			config: Config{TLSCert: "/does/not/matter.pem"},
+		},
+		{
+			name:   "Missing CA file",
+			config: Config{TLSCA: "/does/not/exist.pem"},
+		},
+		{
+			name:   "Invalid inline CA",
+			config: Config{TLSCA: "-----BEGIN CERTIFICATE-----\nnope\n-----END CERTIFICATE-----\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSConfig(&tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	unixSocketScheme = "unix://"
+	// unixSocketBaseUrl replaces a unix:// modSecurityUrl when building the
+	// requests, the transport dials the socket whatever the host is.
+	unixSocketBaseUrl = "http://modsecurity"
+)
+
+// unixSocketPath returns the socket path of a unix:///path/to/socket URL.
+func unixSocketPath(modSecurityUrl string) (string, bool) {
+	if !strings.HasPrefix(modSecurityUrl, unixSocketScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(modSecurityUrl, unixSocketScheme), true
+}
+
+// newTransport builds the http.Transport used to talk with the modsecurity
+// container. Zero values in the configuration mean "use default value".
+func newTransport(config *Config) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   millisOrDefault(config.DialTimeoutMillis, 30*time.Second),
+		KeepAlive: millisOrDefault(config.KeepAliveMillis, 30*time.Second),
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          intOrDefault(config.MaxIdleConns, 100),
+		MaxIdleConnsPerHost:   intOrDefault(config.MaxIdleConnsPerHost, 100),
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       millisOrDefault(config.IdleConnTimeoutMillis, 90*time.Second),
+		ResponseHeaderTimeout: time.Duration(config.ResponseHeaderTimeoutMillis) * time.Millisecond,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if socketPath, ok := unixSocketPath(config.ModSecurityUrl); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	// HTTP/2 is negotiated with ALPN over TLS, HTTP/1 is kept for the WAFs
+	// not offering h2.
+	transport.ForceAttemptHTTP2 = config.HTTP2
+
+	return transport, nil
+}
+
+func millisOrDefault(millis int64, def time.Duration) time.Duration {
+	if millis <= 0 {
+		return def
+	}
+	return time.Duration(millis) * time.Millisecond
+}
+
+func intOrDefault(value int, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
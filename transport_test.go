@@ -0,0 +1,217 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		check  func(t *testing.T, transport *http.Transport)
+	}{
+		{
+			name:   "Uses defaults when nothing is configured",
+			config: Config{},
+			check: func(t *testing.T, transport *http.Transport) {
+				assert.Equal(t, 100, transport.MaxIdleConns)
+				assert.Equal(t, 100, transport.MaxIdleConnsPerHost)
+				assert.Equal(t, 0, transport.MaxConnsPerHost)
+				assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+				assert.Equal(t, time.Duration(0), transport.ResponseHeaderTimeout)
+				assert.False(t, transport.ForceAttemptHTTP2)
+			},
+		},
+		{
+			name: "Applies pool and timeout settings",
+			config: Config{
+				MaxIdleConns:                10,
+				MaxIdleConnsPerHost:         5,
+				MaxConnsPerHost:             20,
+				IdleConnTimeoutMillis:       1500,
+				ResponseHeaderTimeoutMillis: 250,
+			},
+			check: func(t *testing.T, transport *http.Transport) {
+				assert.Equal(t, 10, transport.MaxIdleConns)
+				assert.Equal(t, 5, transport.MaxIdleConnsPerHost)
+				assert.Equal(t, 20, transport.MaxConnsPerHost)
+				assert.Equal(t, 1500*time.Millisecond, transport.IdleConnTimeout)
+				assert.Equal(t, 250*time.Millisecond, transport.ResponseHeaderTimeout)
+			},
+		},
+		{
+			name:   "Enables HTTP/2 over TLS",
+			config: Config{HTTP2: true},
+			check: func(t *testing.T, transport *http.Transport) {
+				assert.True(t, transport.ForceAttemptHTTP2)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := newTransport(&tt.config)
+			assert.NoError(t, err)
+			tt.check(t, transport)
+		})
+	}
+}
+
+func TestNewTransport_HTTP2(t *testing.T) {
+	var proto string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport, _ := newTransport(&Config{HTTP2: true})
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, "HTTP/2.0", proto)
+}
+
+// BenchmarkModsecurity_Transport sends bursts of concurrent requests with
+// idle periods between them. Past the burst, the default transport keeps only
+// http.DefaultMaxIdleConnsPerHost connections and dials the others again on
+// the next burst, the tuned one keeps them all.
+func BenchmarkModsecurity_Transport(b *testing.B) {
+	const concurrency = 32
+
+	tuned, _ := newTransport(&Config{MaxIdleConnsPerHost: concurrency})
+
+	benchmarks := []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{
+			name: "default transport",
+			transport: &http.Transport{
+				MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+			},
+		},
+		{
+			name:      "tuned transport",
+			transport: tuned,
+		},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			modsecurityMockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+			}))
+			// count the connections opened to the WAF to show pooling effects
+			var conns int64
+			modsecurityMockServer.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&conns, 1)
+				}
+			}
+			modsecurityMockServer.Start()
+			defer modsecurityMockServer.Close()
+
+			middleware := &Modsecurity{
+				next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				modSecurityUrl: modsecurityMockServer.URL,
+				maxBodySize:    1024,
+				name:           "modsecurity-middleware",
+				httpClient:     &http.Client{Transport: bm.transport},
+				logger:         log.New(io.Discard, "", log.LstdFlags),
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < concurrency; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						req := httptest.NewRequest(http.MethodPost, "/test", generateLargeBody(512))
+						middleware.ServeHTTP(httptest.NewRecorder(), req)
+					}()
+				}
+				wg.Wait()
+
+				// idle period, the connections go back to the pool
+				b.StopTimer()
+				time.Sleep(time.Millisecond)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestNew_UnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "modsec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "waf.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wafURI string
+	modsecurityMockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wafURI = r.RequestURI
+		if r.URL.Query().Get("test") == "../etc" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	modsecurityMockServer.Listener = listener
+	modsecurityMockServer.Start()
+	defer modsecurityMockServer.Close()
+
+	config := CreateConfig()
+	config.ModSecurityUrl = "unix://" + socketPath
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Response from service"))
+	})
+	handler, err := New(context.Background(), next, config, "modsecurity-middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/website?test=ok", bytes.NewBufferString("Request")))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "Response from service", rw.Body.String())
+	assert.Equal(t, "/website?test=ok", wafURI)
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/website?test=../etc", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestNew_UnixSocketWithoutPath(t *testing.T) {
+	config := CreateConfig()
+	config.ModSecurityUrl = "unix://"
+	_, err := New(context.Background(), http.NotFoundHandler(), config, "modsecurity-middleware")
+	assert.Error(t, err)
+}
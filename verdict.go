@@ -0,0 +1,137 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultRuleIDsHeader = "X-Waf-Rule-Ids"
+	defaultScoreHeader   = "X-Waf-Score"
+)
+
+// wafVerdict is what the WAF answered about a request. The matched rule IDs
+// and the anomaly score are only known if the WAF sends them in headers.
+type wafVerdict struct {
+	status  int
+	ruleIDs []string
+	score   int
+}
+
+func (v wafVerdict) blocked() bool {
+	return v.status >= 400
+}
+
+// isScoreEvaluationRule tells the CRS rules blocking on the anomaly score,
+// which only follow the rules that actually matched.
+func isScoreEvaluationRule(id string) bool {
+	return strings.HasPrefix(id, "949") || strings.HasPrefix(id, "959") || strings.HasPrefix(id, "980")
+}
+
+func ruleIDsHeader(config *Config) string {
+	if config.RuleIDsHeader == "" {
+		return defaultRuleIDsHeader
+	}
+	return config.RuleIDsHeader
+}
+
+func scoreHeader(config *Config) string {
+	if config.ScoreHeader == "" {
+		return defaultScoreHeader
+	}
+	return config.ScoreHeader
+}
+
+// parseVerdict reads the verdict from the WAF response. Rule IDs may be
+// separated by commas or spaces, and spread over several header values.
+func (a *Modsecurity) parseVerdict(resp *http.Response) wafVerdict {
+	v := wafVerdict{status: resp.StatusCode}
+	if a.ruleIDsHeader != "" {
+		for _, value := range resp.Header.Values(a.ruleIDsHeader) {
+			for _, id := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+				v.ruleIDs = append(v.ruleIDs, id)
+			}
+		}
+	}
+	if a.scoreHeader != "" {
+		v.score, _ = strconv.Atoi(strings.TrimSpace(resp.Header.Get(a.scoreHeader)))
+	}
+	return v
+}
+
+// decision is the final decision on a request, from the WAF verdict and the
+// policy endpoint when there is one.
+type decision struct {
+	verdict wafVerdict
+	policy  *policyResult
+	block   bool
+}
+
+// decide takes the decision on the WAF response. The header phase is not
+// final: the policy endpoint is only consulted when it would block the
+// request, an allowed request gets its decision on the full inspection.
+func (a *Modsecurity) decide(req *http.Request, resp *http.Response, bypassMode string, final bool) decision {
+	d := decision{verdict: a.parseVerdict(resp)}
+	d.block = d.verdict.blocked()
+	if d.block && a.exempted(req, d.verdict) {
+		a.logger.Printf("rule exemption overrides modsec block of %s %s, rules %s", req.Method, req.URL.Path, strings.Join(d.verdict.ruleIDs, ","))
+		a.metrics.inc("exemption_overridden")
+		d.block = false
+	}
+	if !final && !d.block {
+		return d
+	}
+	if d.policy = a.policyDecision(req, d.verdict); d.policy != nil {
+		d.block = !d.policy.Allow
+	}
+
+	if d.block && bypassMode == bypassModeDetect {
+		if d.verdict.blocked() {
+			a.logger.Printf("detect-only bypass: modsec would have blocked %s %s with %d", req.Method, req.URL.Path, resp.StatusCode)
+		} else {
+			a.logger.Printf("detect-only bypass: policy would have blocked %s %s", req.Method, req.URL.Path)
+		}
+		a.metrics.inc("bypass_detected")
+		d.block = false
+	}
+	return d
+}
+
+// enforce answers a blocked request, with the WAF response unless the policy
+// endpoint set its own status or message.
+func (a *Modsecurity) enforce(rw http.ResponseWriter, req *http.Request, resp *http.Response, d decision) bool {
+	if !d.block {
+		if d.policy != nil && d.verdict.blocked() {
+			a.logger.Printf("policy allowed %s %s blocked by modsec with %d", req.Method, req.URL.Path, resp.StatusCode)
+			a.metrics.inc("policy_overridden")
+		}
+		return false
+	}
+
+	ev := a.newEvent(req, eventActionBlock, "waf", resp.StatusCode)
+	ev.RuleIDs = d.verdict.ruleIDs
+	ev.Score = d.verdict.score
+
+	if d.policy != nil && (!d.verdict.blocked() || d.policy.Status != 0 || d.policy.Message != "") {
+		status := d.policy.Status
+		if status == 0 {
+			status = http.StatusForbidden
+			if d.verdict.blocked() {
+				status = d.verdict.status
+			}
+		}
+		ev.Reason = "policy"
+		if d.policy.Message != "" {
+			ev.Reason = "policy: " + d.policy.Message
+		}
+		ev.Status = status
+		a.emit(ev)
+		http.Error(rw, d.policy.Message, status)
+		return true
+	}
+
+	a.emit(ev)
+	a.responsePolicy.forward(resp, rw)
+	return true
+}
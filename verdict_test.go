@@ -0,0 +1,26 @@
+package traefik_modsecurity_plugin
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModsecurity_ParseVerdict(t *testing.T) {
+	middleware := &Modsecurity{ruleIDsHeader: defaultRuleIDsHeader, scoreHeader: defaultScoreHeader}
+
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header: http.Header{
+			"X-Waf-Rule-Ids": []string{"930100, 930110", "949110"},
+			"X-Waf-Score":    []string{" 15 "},
+		},
+	}
+
+	verdict := middleware.parseVerdict(resp)
+
+	assert.True(t, verdict.blocked())
+	assert.Equal(t, []string{"930100", "930110", "949110"}, verdict.ruleIDs)
+	assert.Equal(t, 15, verdict.score)
+}
@@ -0,0 +1,215 @@
+// Package wafauth signs and verifies the requests sent by the modsecurity
+// plugin to the WAF, so that a proxy in front of the WAF can reject calls
+// that do not come from the plugin.
+package wafauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderAuthorization carries the static token in bearer mode. A dedicated
+	// header is used so that the client Authorization header still reaches the WAF.
+	HeaderAuthorization = "X-Waf-Authorization"
+	// HeaderTimestamp carries the unix timestamp used in the HMAC signature.
+	HeaderTimestamp = "X-Waf-Timestamp"
+	// HeaderNonce carries the random nonce used in the HMAC signature, so that
+	// identical requests signed in the same second differ.
+	HeaderNonce = "X-Waf-Nonce"
+	// HeaderSignature carries the hex encoded HMAC-SHA256 signature.
+	HeaderSignature = "X-Waf-Signature"
+
+	// DefaultMaxBodySize is the largest body read to check an HMAC signature,
+	// the default maxBodySize of the plugin.
+	DefaultMaxBodySize = 10 * 1024 * 1024
+)
+
+var (
+	ErrMissing  = errors.New("wafauth: missing credentials")
+	ErrInvalid  = errors.New("wafauth: invalid credentials")
+	ErrExpired  = errors.New("wafauth: timestamp outside of the allowed window")
+	ErrReplayed = errors.New("wafauth: nonce already used")
+	ErrTooLarge = errors.New("wafauth: body too large")
+)
+
+// Signature computes the HMAC-SHA256 over the method, the request URI, the
+// timestamp, the nonce and the SHA-256 of the body.
+func Signature(secret []byte, method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, method)
+	io.WriteString(mac, "\n")
+	io.WriteString(mac, requestURI)
+	io.WriteString(mac, "\n")
+	io.WriteString(mac, timestamp)
+	io.WriteString(mac, "\n")
+	io.WriteString(mac, nonce)
+	io.WriteString(mac, "\n")
+	io.WriteString(mac, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignBearer adds the static token to req.
+func SignBearer(req *http.Request, token []byte) {
+	req.Header.Set(HeaderAuthorization, "Bearer "+string(token))
+}
+
+// SignHMAC adds the timestamp, nonce and signature headers to req. body must
+// be the exact body sent with req.
+func SignHMAC(req *http.Request, secret []byte, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := newNonce()
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, Signature(secret, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read does not fail on the supported platforms
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Verifier checks the credentials added by the plugin.
+type Verifier struct {
+	secret  []byte
+	bearer  bool
+	maxSkew time.Duration
+	maxBody int64
+	now     func() time.Time
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewBearerVerifier creates a Verifier accepting requests carrying token.
+func NewBearerVerifier(token []byte) *Verifier {
+	return &Verifier{secret: token, bearer: true, now: time.Now}
+}
+
+// NewHMACVerifier creates a Verifier accepting requests signed with secret
+// less than maxSkew ago. Each nonce is accepted only once.
+func NewHMACVerifier(secret []byte, maxSkew time.Duration) *Verifier {
+	return &Verifier{
+		secret:  secret,
+		maxSkew: maxSkew,
+		maxBody: DefaultMaxBodySize,
+		now:     time.Now,
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// SetMaxBodySize sets the largest body read to check a signature, larger
+// requests fail with ErrTooLarge. It should match the maxBodySize of the
+// plugin.
+func (v *Verifier) SetMaxBodySize(size int64) {
+	v.maxBody = size
+}
+
+// Verify returns nil if req carries valid credentials. In HMAC mode the body
+// is read and replaced so that req can still be forwarded.
+func (v *Verifier) Verify(req *http.Request) error {
+	if v.bearer {
+		token := strings.TrimPrefix(req.Header.Get(HeaderAuthorization), "Bearer ")
+		if token == "" {
+			return ErrMissing
+		}
+		if subtle.ConstantTimeCompare([]byte(token), v.secret) != 1 {
+			return ErrInvalid
+		}
+		return nil
+	}
+
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	signature := req.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return ErrMissing
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	now := v.now()
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-v.maxSkew)) || signedAt.After(now.Add(v.maxSkew)) {
+		return ErrExpired
+	}
+
+	var body []byte
+	if req.Body != nil {
+		// unauthenticated clients must not make the verifier buffer without limit
+		body, err = io.ReadAll(io.LimitReader(req.Body, v.maxBody+1))
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		if int64(len(body)) > v.maxBody {
+			return ErrTooLarge
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	requestURI := req.RequestURI
+	if requestURI == "" {
+		requestURI = req.URL.RequestURI()
+	}
+	expected := Signature(v.secret, req.Method, requestURI, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalid
+	}
+
+	return v.remember(nonce, signedAt.Add(v.maxSkew), now)
+}
+
+// remember records nonce until expiry and rejects it if already seen.
+func (v *Verifier) remember(nonce string, expiry time.Time, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastPrune) > v.maxSkew {
+		for n, exp := range v.nonces {
+			if exp.Before(now) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastPrune = now
+	}
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrReplayed
+	}
+	v.nonces[nonce] = expiry
+	return nil
+}
+
+// Handler rejects with 401 Unauthorized the requests that fail Verify, or
+// with 413 Request Entity Too Large those whose body is too large, and
+// passes the others to next.
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := v.Verify(req); err != nil {
+			status := http.StatusUnauthorized
+			if err == ErrTooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(rw, "", status)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,162 @@
+package wafauth
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSignedRequest(secret []byte, body string, signedAt time.Time) *http.Request {
+	client := httptest.NewRequest(http.MethodPost, "http://waf/website?test=1", bytes.NewBufferString(body))
+	SignHMAC(client, secret, []byte(body), signedAt)
+	req := httptest.NewRequest(http.MethodPost, "/website?test=1", bytes.NewBufferString(body))
+	req.Header = client.Header
+	return req
+}
+
+func TestVerifier_HMAC(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name      string
+		request   func() *http.Request
+		expectErr error
+	}{
+		{
+			name: "Accepts signed request",
+			request: func() *http.Request {
+				return newSignedRequest(secret, "Request", now)
+			},
+		},
+		{
+			name: "Rejects unsigned request",
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/website", nil)
+			},
+			expectErr: ErrMissing,
+		},
+		{
+			name: "Rejects request signed with another secret",
+			request: func() *http.Request {
+				return newSignedRequest([]byte("other"), "Request", now)
+			},
+			expectErr: ErrInvalid,
+		},
+		{
+			name: "Rejects tampered body",
+			request: func() *http.Request {
+				req := newSignedRequest(secret, "Request", now)
+				req.Body = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString("Tampered")).Body
+				return req
+			},
+			expectErr: ErrInvalid,
+		},
+		{
+			name: "Rejects swapped nonce",
+			request: func() *http.Request {
+				req := newSignedRequest(secret, "Request", now)
+				req.Header.Set(HeaderNonce, "0123456789abcdef")
+				return req
+			},
+			expectErr: ErrInvalid,
+		},
+		{
+			name: "Rejects expired signature",
+			request: func() *http.Request {
+				return newSignedRequest(secret, "Request", now.Add(-time.Minute))
+			},
+			expectErr: ErrExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewHMACVerifier(secret, 30*time.Second)
+			verifier.now = func() time.Time { return now }
+
+			err := verifier.Verify(tt.request())
+
+			assert.True(t, errors.Is(err, tt.expectErr), "got %v", err)
+		})
+	}
+}
+
+func TestVerifier_Replay(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+	verifier := NewHMACVerifier(secret, 30*time.Second)
+	verifier.now = func() time.Time { return now }
+
+	req := newSignedRequest(secret, "Request", now)
+	replay := httptest.NewRequest(http.MethodPost, "/website?test=1", bytes.NewBufferString("Request"))
+	replay.Header = req.Header.Clone()
+
+	assert.NoError(t, verifier.Verify(req))
+	assert.Equal(t, ErrReplayed, verifier.Verify(replay))
+}
+
+func TestVerifier_IdenticalRequests(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1700000000, 0)
+	verifier := NewHMACVerifier(secret, 30*time.Second)
+	verifier.now = func() time.Time { return now }
+
+	// the nonce tells apart two legitimate calls signed in the same second
+	first := newSignedRequest(secret, "", now)
+	second := newSignedRequest(secret, "", now)
+
+	assert.NotEqual(t, first.Header.Get(HeaderNonce), second.Header.Get(HeaderNonce))
+	assert.NoError(t, verifier.Verify(first))
+	assert.NoError(t, verifier.Verify(second))
+}
+
+func TestVerifier_Bearer(t *testing.T) {
+	verifier := NewBearerVerifier([]byte("token"))
+
+	valid := httptest.NewRequest(http.MethodGet, "/", nil)
+	SignBearer(valid, []byte("token"))
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	SignBearer(forged, []byte("forged"))
+
+	assert.NoError(t, verifier.Verify(valid))
+	assert.Equal(t, ErrInvalid, verifier.Verify(forged))
+	assert.Equal(t, ErrMissing, verifier.Verify(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestVerifier_Handler(t *testing.T) {
+	verifier := NewBearerVerifier([]byte("token"))
+	handler := verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestVerifier_MaxBodySize(t *testing.T) {
+	secret := []byte("secret")
+	verifier := NewHMACVerifier(secret, 30*time.Second)
+	verifier.SetMaxBodySize(8)
+	handler := verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, newSignedRequest(secret, "Request", time.Now()))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	// the body is not buffered past the limit, signed or not
+	large := httptest.NewRequest(http.MethodPost, "/website?test=1", bytes.NewBufferString("a body larger than the limit"))
+	large.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+	large.Header.Set(HeaderNonce, "nonce")
+	large.Header.Set(HeaderSignature, "forged")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, large)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+
+	assert.Equal(t, ErrTooLarge, verifier.Verify(newSignedRequest(secret, "Request body", time.Now())))
+}
@@ -0,0 +1,146 @@
+package traefik_modsecurity_plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the batch body.
+const webhookSignatureHeader = "X-Waf-Webhook-Signature"
+
+// webhookSink POSTs the events as JSON batches to a URL. Events are queued in
+// a bounded buffer and dropped when it is full, so that a slow webhook never
+// slows down the requests.
+type webhookSink struct {
+	url           string
+	secret        []byte
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+	client        *http.Client
+	events        chan event
+	metrics       *metrics
+	logger        *log.Logger
+}
+
+func newWebhookSink(config *Config, m *metrics, logger *log.Logger) *webhookSink {
+	if config.WebhookUrl == "" {
+		return nil
+	}
+	return &webhookSink{
+		url:           config.WebhookUrl,
+		secret:        []byte(config.WebhookSecret),
+		batchSize:     intOrDefault(config.WebhookBatchSize, 100),
+		flushInterval: millisOrDefault(config.WebhookFlushIntervalMillis, 5*time.Second),
+		maxRetries:    intOrDefault(config.WebhookMaxRetries, 3),
+		retryBackoff:  500 * time.Millisecond,
+		client:        &http.Client{Timeout: millisOrDefault(config.WebhookTimeoutMillis, 5*time.Second)},
+		events:        make(chan event, intOrDefault(config.WebhookBufferSize, 10000)),
+		metrics:       m,
+		logger:        logger,
+	}
+}
+
+func (w *webhookSink) send(ev event) {
+	select {
+	case w.events <- ev:
+	default:
+		w.metrics.inc("webhook_dropped")
+	}
+}
+
+// run batches the events until ctx is done, flushing what remains then.
+func (w *webhookSink) run(ctx context.Context) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]event, 0, w.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			w.deliver(ctx, batch)
+			batch = make([]event, 0, w.batchSize)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case ev := <-w.events:
+			batch = append(batch, ev)
+			if len(batch) >= w.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// deliver POSTs a batch, retrying with an exponential backoff.
+func (w *webhookSink) deliver(ctx context.Context, batch []event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		w.logger.Printf("webhook: fail to encode events: %s", err.Error())
+		w.metrics.add("webhook_dropped", int64(len(batch)))
+		return
+	}
+
+	backoff := w.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			w.metrics.add("webhook_delivered", int64(len(batch)))
+			return
+		}
+		if attempt >= w.maxRetries {
+			break
+		}
+		w.metrics.inc("webhook_retries")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+
+	w.logger.Printf("webhook: fail to deliver %d events: %s", len(batch), err.Error())
+	w.metrics.add("webhook_dropped", int64(len(batch)))
+}
+
+func (w *webhookSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package traefik_modsecurity_plugin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink keeps the events sent by the middleware.
+type recordingSink struct {
+	mu     sync.Mutex
+	events []event
+}
+
+func (s *recordingSink) send(ev event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+}
+
+func TestWebhookSink_Flush(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		events int
+	}{
+		{
+			name:   "Flushes when the batch is full",
+			config: Config{WebhookBatchSize: 2, WebhookFlushIntervalMillis: 60000},
+			events: 2,
+		},
+		{
+			name:   "Flushes on interval",
+			config: Config{WebhookBatchSize: 100, WebhookFlushIntervalMillis: 10},
+			events: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := make(chan []event, 1)
+			webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+
+				mac := hmac.New(sha256.New, []byte("secret"))
+				mac.Write(body)
+				assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(webhookSignatureHeader))
+
+				var batch []event
+				assert.NoError(t, json.Unmarshal(body, &batch))
+				batches <- batch
+			}))
+			defer webhookServer.Close()
+
+			config := tt.config
+			config.WebhookUrl = webhookServer.URL
+			config.WebhookSecret = "secret"
+			m := newMetrics()
+			sink := newWebhookSink(&config, m, log.New(io.Discard, "", log.LstdFlags))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go sink.run(ctx)
+
+			for i := 0; i < tt.events; i++ {
+				sink.send(event{Action: eventActionBlock, URI: "/test", Status: http.StatusForbidden})
+			}
+
+			select {
+			case batch := <-batches:
+				assert.Len(t, batch, tt.events)
+				assert.Equal(t, "/test", batch[0].URI)
+			case <-time.After(2 * time.Second):
+				t.Fatal("batch not delivered")
+			}
+			waitForMetric(t, m, "webhook_delivered", int64(tt.events))
+		})
+	}
+}
+
+func TestWebhookSink_Retries(t *testing.T) {
+	var calls int32
+	webhookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer webhookServer.Close()
+
+	m := newMetrics()
+	sink := newWebhookSink(&Config{WebhookUrl: webhookServer.URL, WebhookMaxRetries: 3}, m, log.New(io.Discard, "", log.LstdFlags))
+	sink.retryBackoff = time.Millisecond
+
+	sink.deliver(context.Background(), []event{{Action: eventActionError}})
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, int64(2), m.get("webhook_retries"))
+	assert.Equal(t, int64(1), m.get("webhook_delivered"))
+
+	atomic.StoreInt32(&calls, -10)
+	sink.deliver(context.Background(), []event{{Action: eventActionError}})
+	assert.Equal(t, int64(1), m.get("webhook_dropped"))
+}
+
+func TestWebhookSink_DropsWhenFull(t *testing.T) {
+	m := newMetrics()
+	sink := newWebhookSink(&Config{WebhookUrl: "http://webhook.invalid", WebhookBufferSize: 1}, m, log.New(io.Discard, "", log.LstdFlags))
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		sink.send(event{Action: eventActionBlock})
+	}
+
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, int64(2), m.get("webhook_dropped"))
+}
+
+func TestModsecurity_ServeHTTP_Events(t *testing.T) {
+	modsecurityMockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer modsecurityMockServer.Close()
+
+	sink := &recordingSink{}
+	middleware := &Modsecurity{
+		next:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		modSecurityUrl: modsecurityMockServer.URL,
+		maxBodySize:    1024,
+		name:           "modsecurity-middleware",
+		httpClient:     http.DefaultClient,
+		logger:         log.New(io.Discard, "", log.LstdFlags),
+		sinks:          []eventSink{sink},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/test?test=../etc", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	middleware.modSecurityUrl = "http://127.0.0.1:1"
+	middleware.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	assert.Len(t, sink.events, 2)
+	assert.Equal(t, eventActionBlock, sink.events[0].Action)
+	assert.Equal(t, "10.0.0.1", sink.events[0].ClientIP)
+	assert.Equal(t, "/test?test=../etc", sink.events[0].URI)
+	assert.Equal(t, http.StatusForbidden, sink.events[0].Status)
+	assert.Equal(t, "modsecurity-middleware", sink.events[0].Middleware)
+	assert.Equal(t, eventActionError, sink.events[1].Action)
+	assert.Equal(t, http.StatusBadGateway, sink.events[1].Status)
+}